@@ -0,0 +1,59 @@
+package tosync
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// AckResponder 决定callback接口给下游的响应，err为nil表示回调处理成功。
+// 不同下游对响应格式要求不同，格式不对时下游会一直重试
+type AckResponder interface {
+	Respond(w http.ResponseWriter, r *http.Request, err error)
+}
+
+type AckResponderFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+func (f AckResponderFunc) Respond(w http.ResponseWriter, r *http.Request, err error) {
+	f(w, r, err)
+}
+
+// NewAck 成功时返回固定的状态码和body，失败时按错误类型返回状态码
+func NewAck(status int, contentType string, body []byte) AckResponder {
+	return AckResponderFunc(func(w http.ResponseWriter, r *http.Request, err error) {
+		if err != nil {
+			writeCallbackError(w, err)
+			return
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	})
+}
+
+// TextAck 成功时返回纯文本，如SUCCESS
+func TextAck(body string) AckResponder {
+	return NewAck(http.StatusOK, "text/plain; charset=utf-8", []byte(body))
+}
+
+// JSONAck 成功时返回v序列化后的json，如{"code":0,"msg":"ok"}
+func JSONAck(v any) (AckResponder, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal ack body")
+	}
+	return NewAck(http.StatusOK, "application/json", buf), nil
+}
+
+// XMLAck 成功时原样返回xml，如<xml><return_code>SUCCESS</return_code></xml>
+func XMLAck(body string) AckResponder {
+	return NewAck(http.StatusOK, "application/xml; charset=utf-8", []byte(body))
+}
+
+// StatusAck 成功时只返回状态码，如204
+func StatusAck(status int) AckResponder {
+	return NewAck(status, "", nil)
+}
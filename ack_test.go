@@ -0,0 +1,41 @@
+package tosync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAckResponder(t *testing.T) {
+	jsonAck, err := JSONAck(map[string]any{"code": 0, "msg": "ok"})
+	if err != nil {
+		t.Fatalf("new json ack failed: %v", err)
+	}
+	cases := []struct {
+		responder   AckResponder
+		err         error
+		status      int
+		contentType string
+		body        string
+	}{
+		{TextAck("SUCCESS"), nil, http.StatusOK, "text/plain; charset=utf-8", "SUCCESS"},
+		{jsonAck, nil, http.StatusOK, "application/json", `{"code":0,"msg":"ok"}`},
+		{XMLAck("<xml><return_code>SUCCESS</return_code></xml>"), nil, http.StatusOK, "application/xml; charset=utf-8", "<xml><return_code>SUCCESS</return_code></xml>"},
+		{StatusAck(http.StatusNoContent), nil, http.StatusNoContent, "", ""},
+		// 失败时按错误类型返回状态码
+		{TextAck("SUCCESS"), ErrInvalidSign, http.StatusForbidden, "text/plain; charset=utf-8", "Forbidden\n"},
+	}
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		c.responder.Respond(w, httptest.NewRequest(http.MethodPost, "/callback", nil), c.err)
+		if w.Code != c.status {
+			t.Fatalf("case %d: want status %d, get %d", i, c.status, w.Code)
+		}
+		if get := w.Header().Get("Content-Type"); get != c.contentType {
+			t.Fatalf("case %d: want content type %s, get %s", i, c.contentType, get)
+		}
+		if get := w.Body.String(); get != c.body {
+			t.Fatalf("case %d: want body %s, get %s", i, c.body, get)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package tosync
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultConcurrency ToSyncAll默认同时提交的任务数
+const DefaultConcurrency = 8
+
+// Result ToSyncAll中一个请求的结果，与reqs按下标对应
+type Result[CallbackData any] struct {
+	AsyncID string // 提交失败时为空
+	Data    CallbackData
+	Err     error // 提交失败、超时、回调报告失败等，各请求独立
+}
+
+// ToSyncAll 用同一个async批量转换reqs：按Option.SetConcurrency限制同时提交的数量，
+// 按Option.SetRate限制提交速率，提交成功的任务同时等待各自的回调。
+// 每个请求的超时从各自提交开始计算，结果与reqs按下标对应
+func ToSyncAll[Req ReqI, CallbackData any](ctx context.Context, reqs []Req, async func(context.Context, Req) error, opts ...*Option) []Result[CallbackData] {
+	opt := mergeOptions(opts...)
+	results := make([]Result[CallbackData], len(reqs))
+
+	// 类型不对时不提交
+	err := checkType[CallbackData]()
+	if err == nil && opt.AsyncID != "" {
+		err = errors.New("async id can not be set in ToSyncAll")
+	}
+	if err == nil {
+		_, err = doneFunc[CallbackData](opt)
+	}
+	if err == nil {
+		_, err = resultErrFunc[CallbackData](opt)
+	}
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+
+	concurrency := opt.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	if concurrency > len(reqs) {
+		concurrency = len(reqs)
+	}
+	limiter := newRateLimiter(opt.Rate)
+
+	// 多个goroutine提交，提交成功的任务各自等待回调。
+	// 不按顺序等待，否则DoneWhen时后面任务的中间回调会堆满channel，终态回调被丢弃
+	indexC := make(chan int, len(reqs))
+	for i := range reqs {
+		indexC <- i
+	}
+	close(indexC)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexC {
+				err := limiter.wait(ctx)
+				var ticket *Ticket
+				if err == nil {
+					ticket, err = Submit(ctx, reqs[i], async, opt)
+				}
+				if err != nil {
+					results[i].Err = err
+					continue
+				}
+				results[i].AsyncID = ticket.AsyncID()
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					defer ticket.Cancel()
+					env, err := waitTicket[CallbackData](ctx, ticket)
+					if env != nil {
+						results[i].Data = env.Data
+					}
+					results[i].Err = err
+				}(i)
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// 按固定间隔放行，rate为每秒次数，不大于0时不限制
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / rate),
+	}
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.lock.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,179 @@
+package tosync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestToSyncAll(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client).SetTimeout(time.Millisecond * 300)
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	submitErr := errors.New("submit failed")
+	reqs := make([]*TestReq, 10)
+	for i := range reqs {
+		reqs[i] = &TestReq{}
+	}
+	async := func(ctx context.Context, req *TestReq) error {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(time.Millisecond * 20)
+		lock.Lock()
+		running--
+		lock.Unlock()
+
+		index := -1
+		for i := range reqs {
+			if reqs[i] == req {
+				index = i
+			}
+		}
+		switch index {
+		case 3:
+			return submitErr
+		case 5:
+			// 永不回调
+			return nil
+		}
+		go func() {
+			resp, err := http.Post(req.GetCallbackURL(), "application/json", strings.NewReader(fmt.Sprintf(`{"msg":"%d"}`, index)))
+			if err != nil {
+				t.Errorf("post callback failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return nil
+	}
+
+	results := ToSyncAll[*TestReq, TestCallbackData](ctx, reqs, async, opt, new(Option).SetConcurrency(3))
+	if len(results) != len(reqs) {
+		t.Fatalf("want %d results, get %d", len(reqs), len(results))
+	}
+	for i, result := range results {
+		switch i {
+		case 3:
+			if !errors.Is(result.Err, submitErr) || result.AsyncID != "" {
+				t.Fatalf("%d: want %v, get %+v", i, submitErr, result)
+			}
+		case 5:
+			if !errors.Is(result.Err, context.DeadlineExceeded) || result.AsyncID == "" {
+				t.Fatalf("%d: want %v, get %+v", i, context.DeadlineExceeded, result)
+			}
+		default:
+			if result.Err != nil || result.Data.Msg != fmt.Sprint(i) {
+				t.Fatalf("%d: want %d, get %+v", i, i, result)
+			}
+		}
+	}
+	if maxRunning > 3 {
+		t.Fatalf("want concurrency 3, get %d", maxRunning)
+	}
+	client.lock.RLock()
+	waiters := len(client.waiters)
+	client.lock.RUnlock()
+	if waiters != 0 {
+		t.Fatalf("want waiters released, get %d", waiters)
+	}
+
+	// 限制提交速率
+	reqs = reqs[:5]
+	for i := range reqs {
+		reqs[i] = &TestReq{}
+	}
+	start := time.Now()
+	results = ToSyncAll[*TestReq, TestCallbackData](ctx, reqs, func(ctx context.Context, req *TestReq) error {
+		return submitErr
+	}, opt, new(Option).SetConcurrency(5).SetRate(50))
+	if cost := time.Since(start); cost < time.Millisecond*80 {
+		t.Fatalf("want rate limited, cost %v", cost)
+	}
+	for i, result := range results {
+		if !errors.Is(result.Err, submitErr) {
+			t.Fatalf("%d: want %v, get %v", i, submitErr, result.Err)
+		}
+	}
+
+	// 不能指定async_id
+	results = ToSyncAll[*TestReq, TestCallbackData](ctx, []*TestReq{{}, {}}, async, opt, new(Option).SetAsyncID("order"))
+	for i, result := range results {
+		if result.Err == nil {
+			t.Fatalf("%d: want error for async id", i)
+		}
+	}
+}
+
+// 多次回调时各任务同时等待，排在前面的任务未结束不影响后面任务的终态回调
+func TestToSyncAllDoneWhen(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	reqs := []*TestReq{{}, {}}
+	post := func(callbackURL, msg string) {
+		resp, err := http.Post(callbackURL, "application/json", strings.NewReader(`{"msg":"`+msg+`"}`))
+		if err != nil {
+			t.Errorf("post callback failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+	async := func(ctx context.Context, req *TestReq) error {
+		go func() {
+			if req == reqs[0] {
+				time.Sleep(time.Millisecond * 300)
+				post(req.GetCallbackURL(), "done")
+				return
+			}
+			// 中间回调超过channel容量
+			for i := 0; i < streamBufferSize+4; i++ {
+				post(req.GetCallbackURL(), "processing")
+			}
+			post(req.GetCallbackURL(), "done")
+		}()
+		return nil
+	}
+	results := ToSyncAll[*TestReq, TestCallbackData](ctx, reqs, async, new(Option).SetClient(client).SetTimeout(time.Second),
+		DoneWhen(func(data TestCallbackData) (bool, error) {
+			return data.Msg == "done", nil
+		}))
+	for i, result := range results {
+		if result.Err != nil || result.Data.Msg != "done" {
+			t.Fatalf("%d: want done, get %+v", i, result)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	if err := newRateLimiter(0).wait(ctx); err != nil {
+		t.Fatalf("unlimited wait failed: %v", err)
+	}
+	limiter := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.wait(ctx); err != nil {
+			t.Fatalf("wait failed: %v", err)
+		}
+	}
+	if cost := time.Since(start); cost < time.Millisecond*20 {
+		t.Fatalf("want at least 20ms, cost %v", cost)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := limiter.wait(canceled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, get %v", context.Canceled, err)
+	}
+}
@@ -2,32 +2,79 @@ package tosync
 
 import (
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/pkg/errors"
 )
 
 type Config struct {
-	CallbackURL      string `json:"callback_url" yaml:"callback_url" validate:"url"`              // 回调地址
-	MaxCallbackBytes int64  `json:"max_callback_bytes" yaml:"max_callback_bytes" validate:"gt=0"` // 回调body限制
-	Stream           string `json:"stream" yaml:"stream" validate:"gt=0"`                         // 回调stream key
-	TimeoutSeconds   int    `json:"timeout_seconds" yaml:"timeout_seconds" validate:"gt=0"`       // 超时时间
+	CallbackURL         string    `json:"callback_url" yaml:"callback_url" validate:"url"`                     // 回调地址，路径中含{sig}（可选{async_id}）时签名放在路径中，否则放在query参数中
+	MaxCallbackBytes    int64     `json:"max_callback_bytes" yaml:"max_callback_bytes" validate:"gt=0"`        // 回调body限制
+	Stream              string    `json:"stream" yaml:"stream" validate:"gt=0"`                                // 回调stream key
+	TimeoutSeconds      int       `json:"timeout_seconds" yaml:"timeout_seconds" validate:"gt=0"`              // 超时时间
+	AckBody             string    `json:"ack_body" yaml:"ack_body"`                                            // HTTPHandler处理成功时的响应body，默认success
+	SignKeys            []SignKey `json:"sign_keys" yaml:"sign_keys" validate:"gt=0,dive"`                     // 回调地址签名密钥，第一个用于签名，全部用于校验
+	SignGraceSeconds    int       `json:"sign_grace_seconds" yaml:"sign_grace_seconds" validate:"gte=0"`       // 回调地址在超时之后仍有效的时间，默认5分钟
+	RetainSeconds       int       `json:"retain_seconds" yaml:"retain_seconds" validate:"gte=0"`               // stream中消息的保留时间，默认10分钟
+	MaxStreamLen        int64     `json:"max_stream_len" yaml:"max_stream_len" validate:"gte=0"`               // stream的最大长度（近似），默认不限制
+	TrimIntervalSeconds int       `json:"trim_interval_seconds" yaml:"trim_interval_seconds" validate:"gte=0"` // 后台修剪stream的间隔，默认不开启
+	ForwardHeaders      []string  `json:"forward_headers" yaml:"forward_headers"`                              // 转发给等待方的回调header，"*"为全部，默认不转发
+	ForwardQuery        []string  `json:"forward_query" yaml:"forward_query"`                                  // 转发给等待方的回调query参数，"*"为全部（不含签名参数），默认不转发
+}
+
+type SignKey struct {
+	ID     string `json:"id" yaml:"id" validate:"alphanum"`       // 密钥id，会出现在回调地址中
+	Secret string `json:"secret" yaml:"secret" validate:"min=16"` // 密钥，不要提交到代码仓库
 }
 
 func (c Config) Validate() error {
-	// 校验callbackURL
+	// 校验callbackURL，路径中可以有{async_id}、{sig}占位符
 	_, err := url.Parse(c.CallbackURL)
 	if err != nil {
 		return err
 	}
+	_, err = parsePathTemplate(c.CallbackURL)
+	if err != nil {
+		return err
+	}
+
+	// 密钥id不能重复
+	keyIDs := make(map[string]bool, len(c.SignKeys))
+	for _, key := range c.SignKeys {
+		if keyIDs[key.ID] {
+			return errors.Errorf("sign key %s duplicated", key.ID)
+		}
+		keyIDs[key.ID] = true
+	}
 
 	// 校验validate label
 	return validator.New().Struct(c)
 }
 
 type Option struct {
-	Client  *Client
-	Timeout time.Duration
+	Client      *Client
+	Timeout     time.Duration
+	Ack         string       // 使用的AckResponder名字，需要先通过ClientOption.SetAckResponder注册
+	Decoder     Decoder      // 回调body的解析方式，不设置时按Content-Type选择
+	Verifier    string       // 使用的CallbackVerifier名字，需要先通过ClientOption.SetVerifier注册
+	AsyncID     string       // 指定async_id（如业务单号），便于之后Await、Lookup，不设置时随机生成。只能包含字母、数字和._~-，且不能复用
+	Concurrency int          // ToSyncAll同时提交的任务数，默认DefaultConcurrency
+	Rate        float64      // ToSyncAll每秒最多提交的任务数，默认不限制
+	EarlyAccept bool         // async返回错误（含客户端超时）时，如果回调已经到达，以回调为准返回结果。未配置ResultStore时只等待回调送达500ms
+	Retry       *RetryPolicy // async返回错误时的重试策略，不设置时不重试
+	done        any          // func(CallbackData) (bool, error)，由DoneWhen设置
+	resultErr   any          // func(CallbackData) error，由WithResultError设置
+}
+
+// DoneWhen 判断回调是否为终态，ToSync会忽略非终态的回调（如status为processing）继续等待，
+// 返回的err不为nil时ToSync直接返回该错误。client开启DedupFirstWins去重时不能使用
+func DoneWhen[CallbackData any](fn func(CallbackData) (done bool, err error)) *Option {
+	if fn == nil {
+		return &Option{}
+	}
+	return &Option{done: fn}
 }
 
 func (o *Option) SetClient(client *Client) *Option {
@@ -40,6 +87,48 @@ func (o *Option) SetTimeout(timeout time.Duration) *Option {
 	return o
 }
 
+func (o *Option) SetAck(name string) *Option {
+	o.Ack = name
+	return o
+}
+
+func (o *Option) SetVerifier(name string) *Option {
+	o.Verifier = name
+	return o
+}
+
+// SetAsyncID 指定async_id，只能包含字母、数字和._~-。
+// 同一个async_id只能提交一次：配置了ResultStore时，已有保存结果的async_id会被拒绝
+func (o *Option) SetAsyncID(asyncID string) *Option {
+	o.AsyncID = asyncID
+	return o
+}
+
+func (o *Option) SetConcurrency(concurrency int) *Option {
+	o.Concurrency = concurrency
+	return o
+}
+
+func (o *Option) SetRate(perSecond float64) *Option {
+	o.Rate = perSecond
+	return o
+}
+
+func (o *Option) SetEarlyAccept(accept bool) *Option {
+	o.EarlyAccept = accept
+	return o
+}
+
+func (o *Option) SetRetry(policy *RetryPolicy) *Option {
+	o.Retry = policy
+	return o
+}
+
+func (o *Option) SetDecoder(decoder Decoder) *Option {
+	o.Decoder = decoder
+	return o
+}
+
 func mergeOptions(opts ...*Option) *Option {
 	opt := &Option{}
 	for _, o := range opts {
@@ -49,6 +138,143 @@ func mergeOptions(opts ...*Option) *Option {
 		if o.Timeout > 0 {
 			opt.Timeout = o.Timeout
 		}
+		if o.Ack != "" {
+			opt.Ack = o.Ack
+		}
+		if o.Decoder != nil {
+			opt.Decoder = o.Decoder
+		}
+		if o.Verifier != "" {
+			opt.Verifier = o.Verifier
+		}
+		if o.AsyncID != "" {
+			opt.AsyncID = o.AsyncID
+		}
+		if o.EarlyAccept {
+			opt.EarlyAccept = true
+		}
+		if o.Retry != nil {
+			opt.Retry = o.Retry
+		}
+		if o.Concurrency > 0 {
+			opt.Concurrency = o.Concurrency
+		}
+		if o.Rate > 0 {
+			opt.Rate = o.Rate
+		}
+		if o.done != nil {
+			opt.done = o.done
+		}
+		if o.resultErr != nil {
+			opt.resultErr = o.resultErr
+		}
+	}
+	return opt
+}
+
+type ClientOption struct {
+	Messager        Messager                // 自定义消息通道，不设置时使用redis stream
+	AckResponders   map[string]AckResponder // 名字 -> callback响应格式，""为默认
+	Deduper         Deduper                 // 按async_id去重callback，不设置时不去重
+	DedupPolicy     DedupPolicy
+	Decoders        map[string]Decoder          // Content-Type -> 回调body的解析方式，优先于内置的
+	Verifiers       map[string]CallbackVerifier // 名字 -> 下游签名的校验方式，""为默认
+	TaskIDExtractor TaskIDExtractor             // 从回调中取下游任务id，用于ToSyncTask
+	ResultStore     ResultStore                 // 持久化回调，用于Await、Lookup
+	ResultTTL       time.Duration
+}
+
+func (o *ClientOption) SetMessager(msger Messager) *ClientOption {
+	o.Messager = msger
+	return o
+}
+
+// SetAckResponder 注册callback响应格式，name为空时替换默认格式，
+// 非空时可通过Option.SetAck按注册选择
+func (o *ClientOption) SetAckResponder(name string, responder AckResponder) *ClientOption {
+	if o.AckResponders == nil {
+		o.AckResponders = make(map[string]AckResponder)
+	}
+	o.AckResponders[name] = responder
+	return o
+}
+
+// SetDeduper 开启callback去重，policy决定重复的callback是被丢弃还是覆盖旧结果
+func (o *ClientOption) SetDeduper(deduper Deduper, policy DedupPolicy) *ClientOption {
+	o.Deduper = deduper
+	o.DedupPolicy = policy
+	return o
+}
+
+// SetVerifier 注册下游签名的校验方式，name为空时对所有回调生效，
+// 非空时可通过Option.SetVerifier按注册选择，替代默认的校验方式
+func (o *ClientOption) SetVerifier(name string, verifier CallbackVerifier) *ClientOption {
+	if o.Verifiers == nil {
+		o.Verifiers = make(map[string]CallbackVerifier)
+	}
+	o.Verifiers[name] = verifier
+	return o
+}
+
+// SetTaskIDExtractor 开启按下游任务id关联：未带签名的回调（如回调到固定的Config.CallbackURL）
+// 用extractor取出任务id，交给ToSyncTask中等待该任务的调用方。
+// 固定地址没有签名保护，必须同时用SetVerifier("", ...)校验下游的签名，否则NewClient返回错误
+func (o *ClientOption) SetTaskIDExtractor(extractor TaskIDExtractor) *ClientOption {
+	o.TaskIDExtractor = extractor
+	return o
+}
+
+// SetResultStore 按async_id持久化每次回调，ttl为0时使用DefaultResultTTL
+func (o *ClientOption) SetResultStore(store ResultStore, ttl time.Duration) *ClientOption {
+	o.ResultStore = store
+	o.ResultTTL = ttl
+	return o
+}
+
+// SetDecoder 注册Content-Type对应的Decoder，如application/x-protobuf
+func (o *ClientOption) SetDecoder(contentType string, decoder Decoder) *ClientOption {
+	if o.Decoders == nil {
+		o.Decoders = make(map[string]Decoder)
+	}
+	o.Decoders[strings.ToLower(contentType)] = decoder
+	return o
+}
+
+func mergeClientOptions(opts ...*ClientOption) *ClientOption {
+	opt := &ClientOption{}
+	for _, o := range opts {
+		if o.Messager != nil {
+			opt.Messager = o.Messager
+		}
+		if o.Deduper != nil {
+			opt.Deduper = o.Deduper
+			opt.DedupPolicy = o.DedupPolicy
+		}
+		if o.TaskIDExtractor != nil {
+			opt.TaskIDExtractor = o.TaskIDExtractor
+		}
+		if o.ResultStore != nil {
+			opt.ResultStore = o.ResultStore
+			opt.ResultTTL = o.ResultTTL
+		}
+		for name, verifier := range o.Verifiers {
+			if opt.Verifiers == nil {
+				opt.Verifiers = make(map[string]CallbackVerifier)
+			}
+			opt.Verifiers[name] = verifier
+		}
+		for contentType, decoder := range o.Decoders {
+			if opt.Decoders == nil {
+				opt.Decoders = make(map[string]Decoder)
+			}
+			opt.Decoders[contentType] = decoder
+		}
+		for name, responder := range o.AckResponders {
+			if opt.AckResponders == nil {
+				opt.AckResponders = make(map[string]AckResponder)
+			}
+			opt.AckResponders[name] = responder
+		}
 	}
 	return opt
 }
@@ -8,6 +8,7 @@ func TestConfig_Validate(t *testing.T) {
 		MaxCallbackBytes: 1,
 		Stream:           "123",
 		TimeoutSeconds:   10,
+		SignKeys:         []SignKey{{ID: "k1", Secret: "0123456789abcdef"}},
 	}
 	err := cfg.Validate()
 	if err != nil {
@@ -69,4 +70,37 @@ func TestConfig_Validate(t *testing.T) {
 			t.Fatal("expect error")
 		}
 	}
+
+	// 签名密钥必须有值
+	{
+		tmp := cfg
+		tmp.SignKeys = nil
+		err = tmp.Validate()
+		if err == nil {
+			t.Fatal("expect error")
+		}
+	}
+
+	// 密钥不能太短
+	{
+		tmp := cfg
+		tmp.SignKeys = []SignKey{{ID: "k1", Secret: "short"}}
+		err = tmp.Validate()
+		if err == nil {
+			t.Fatal("expect error")
+		}
+	}
+
+	// 密钥id不能重复
+	{
+		tmp := cfg
+		tmp.SignKeys = []SignKey{
+			{ID: "k1", Secret: "0123456789abcdef"},
+			{ID: "k1", Secret: "fedcba9876543210"},
+		}
+		err = tmp.Validate()
+		if err == nil {
+			t.Fatal("expect error")
+		}
+	}
 }
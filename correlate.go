@@ -0,0 +1,186 @@
+package tosync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zeromicro/go-zero/core/logc"
+)
+
+var ErrTaskIDMissing = errors.New("task id missing")
+
+const (
+	taskKeyPrefix = "task:" // 按下游任务id关联时waiter的key前缀，与uuid形式的async_id区分
+
+	orphanRetainDur = time.Minute // 先于注册到达的回调的保留时间
+	maxOrphans      = 1024        // 最多暂存的回调数
+)
+
+// TaskIDExtractor 从回调请求中取出下游自己的任务id，
+// 用于只回调固定地址、不接受逐任务callbackURL的下游
+type TaskIDExtractor interface {
+	TaskID(r *http.Request, body []byte) (string, error)
+}
+
+type TaskIDExtractorFunc func(r *http.Request, body []byte) (string, error)
+
+func (f TaskIDExtractorFunc) TaskID(r *http.Request, body []byte) (string, error) {
+	return f(r, body)
+}
+
+// JSONTaskID 按"."分隔的路径从json body中取任务id，如"data.task_id"，数组用下标如"items.0.id"
+func JSONTaskID(path string) TaskIDExtractor {
+	keys := strings.Split(path, ".")
+	return TaskIDExtractorFunc(func(r *http.Request, body []byte) (string, error) {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var node any
+		err := decoder.Decode(&node)
+		if err != nil {
+			return "", errors.Wrap(err, "unmarshal body")
+		}
+		for _, key := range keys {
+			switch tmp := node.(type) {
+			case map[string]any:
+				node = tmp[key]
+			case []any:
+				index, err := strconv.Atoi(key)
+				if err != nil || index < 0 || index >= len(tmp) {
+					return "", errors.Errorf("index %s of %s out of range", key, path)
+				}
+				node = tmp[index]
+			default:
+				return "", errors.Errorf("path %s not found", path)
+			}
+		}
+		switch tmp := node.(type) {
+		case string:
+			return tmp, nil
+		case json.Number:
+			return tmp.String(), nil
+		default:
+			return "", errors.Errorf("value of %s is %T, want string or number", path, node)
+		}
+	})
+}
+
+// FormTaskID 从x-www-form-urlencoded的body中取任务id
+func FormTaskID(field string) TaskIDExtractor {
+	return TaskIDExtractorFunc(func(r *http.Request, body []byte) (string, error) {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", errors.Wrap(err, "parse form body")
+		}
+		return values.Get(field), nil
+	})
+}
+
+// HeaderTaskID 从header中取任务id
+func HeaderTaskID(header string) TaskIDExtractor {
+	return TaskIDExtractorFunc(func(r *http.Request, body []byte) (string, error) {
+		return r.Header.Get(header), nil
+	})
+}
+
+func taskKey(taskID string) string {
+	return taskKeyPrefix + taskID
+}
+
+// 未带签名的回调，且配置了TaskIDExtractor时按下游任务id关联
+func (c *Client) correlating(r *http.Request) bool {
+	return c.taskIDExtractor != nil && c.parseClaims(r).AsyncID == ""
+}
+
+// 取出回调中的下游任务id，作为waiter的key
+func (c *Client) extractTaskKey(r *http.Request, body []byte) (string, error) {
+	taskID, err := c.taskIDExtractor.TaskID(r, body)
+	if err != nil {
+		return "", errors.Wrapf(ErrTaskIDMissing, "%v", err)
+	}
+	if taskID == "" {
+		return "", ErrTaskIDMissing
+	}
+	return taskKey(taskID), nil
+}
+
+// 按下游任务id注册waiter，并投递先于注册到达的回调
+func (c *Client) registTask(taskID string, bufSize int) (*WaiterInfo, error) {
+	if c.taskIDExtractor == nil {
+		return nil, errors.New("task id extractor not set")
+	}
+	if taskID == "" {
+		return nil, errors.New("task id is empty")
+	}
+	key := taskKey(taskID)
+	info := &WaiterInfo{
+		AsyncID: key,
+		ResultC: make(chan *CallbackInfoParsed, bufSize),
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if _, ok := c.waiters[key]; ok {
+		return nil, errors.Errorf("task %s already registered", taskID)
+	}
+	c.waiters[key] = info
+
+	for _, orphan := range c.orphans[key] {
+		select {
+		case info.ResultC <- orphan.parsed:
+		default:
+		}
+		c.orphanCount--
+	}
+	delete(c.orphans, key)
+	return info, nil
+}
+
+// 先于注册到达的回调
+type orphanCallback struct {
+	parsed *CallbackInfoParsed
+	at     time.Time
+}
+
+// 暂存还没有waiter的回调，与registTask在同一把锁内，期间已注册时返回对应的waiter
+func (c *Client) keepOrphan(key string, parsed *CallbackInfoParsed) (*WaiterInfo, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if waitInfo, ok := c.waiters[key]; ok {
+		return waitInfo, true
+	}
+
+	now := time.Now()
+	for k, orphans := range c.orphans {
+		kept := orphans[:0]
+		for _, orphan := range orphans {
+			if now.Sub(orphan.at) < orphanRetainDur {
+				kept = append(kept, orphan)
+			}
+		}
+		c.orphanCount -= len(orphans) - len(kept)
+		if len(kept) == 0 {
+			delete(c.orphans, k)
+		} else {
+			c.orphans[k] = kept
+		}
+	}
+	if c.orphanCount >= maxOrphans {
+		logc.Errorf(context.Background(), "[ToSync] too many orphan callbacks, drop %s", key)
+		return nil, false
+	}
+	if c.orphans == nil {
+		c.orphans = make(map[string][]*orphanCallback)
+	}
+	c.orphans[key] = append(c.orphans[key], &orphanCallback{parsed: parsed, at: now})
+	c.orphanCount++
+	return nil, false
+}
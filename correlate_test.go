@@ -0,0 +1,149 @@
+package tosync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestTaskIDExtractor(t *testing.T) {
+	cases := []struct {
+		extractor TaskIDExtractor
+		body      string
+		header    string
+		want      string
+		ok        bool
+	}{
+		{JSONTaskID("task_id"), `{"task_id":"t1"}`, "", "t1", true},
+		{JSONTaskID("data.task_id"), `{"data":{"task_id":1234567890123}}`, "", "1234567890123", true},
+		{JSONTaskID("items.1.id"), `{"items":[{"id":"a"},{"id":"b"}]}`, "", "b", true},
+		{JSONTaskID("items.2.id"), `{"items":[{"id":"a"},{"id":"b"}]}`, "", "", false},
+		{JSONTaskID("data.task_id"), `{"data":"t1"}`, "", "", false},
+		{JSONTaskID("data"), `{"data":{}}`, "", "", false},
+		{JSONTaskID("task_id"), `not json`, "", "", false},
+		{FormTaskID("out_trade_no"), `out_trade_no=t1&status=ok`, "", "t1", true},
+		{HeaderTaskID("X-Task-Id"), ``, "t1", "t1", true},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(c.body))
+		r.Header.Set("X-Task-Id", c.header)
+		get, err := c.extractor.TaskID(r, []byte(c.body))
+		if (err == nil) != c.ok {
+			t.Fatalf("case %d: want ok %v, get %v", i, c.ok, err)
+		}
+		if get != c.want {
+			t.Fatalf("case %d: want %s, get %s", i, c.want, get)
+		}
+	}
+}
+
+func TestToSyncTask(t *testing.T) {
+	ctx := context.Background()
+	// 没有默认verifier时不能开启
+	_, err := NewClient(nil, &Config{
+		CallbackURL:      "http://localhost/callback",
+		MaxCallbackBytes: 1024,
+		Stream:           "to_sync_test",
+		TimeoutSeconds:   10,
+		SignKeys:         testSignKeys,
+	}, new(ClientOption).
+		SetMessager(NewMemoryMessager(nil)).
+		SetTaskIDExtractor(JSONTaskID("task_id")))
+	if err == nil || !strings.Contains(err.Error(), "default callback verifier") {
+		t.Fatalf("want verifier required error, get %v", err)
+	}
+
+	acceptAll := CallbackVerifierFunc(func(r *http.Request, body []byte) error {
+		return nil
+	})
+	client, callbackURL := newTestClient(t, 1024*1024, 10, new(ClientOption).
+		SetVerifier("", acceptAll).
+		SetTaskIDExtractor(JSONTaskID("task_id")))
+	opt := new(Option).SetClient(client)
+
+	post := func(body string) {
+		resp, err := http.Post(callbackURL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Errorf("post callback failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("want %d, get %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// 回调在async返回之后到达
+	data, err := ToSyncTask[TestCallbackData](ctx, func(ctx context.Context) (string, error) {
+		go func() {
+			time.Sleep(time.Millisecond * 50)
+			post(`{"task_id":"t1","msg":"late"}`)
+		}()
+		return "t1", nil
+	}, opt)
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "late" {
+		t.Fatalf("want late, get %s", data.Msg)
+	}
+
+	// 回调先于async返回到达
+	env, err := ToSyncTaskRaw[TestCallbackData](ctx, func(ctx context.Context) (string, error) {
+		post(`{"task_id":"t2","msg":"early"}`)
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond * 10) {
+			client.lock.RLock()
+			kept := len(client.orphans[taskKey("t2")])
+			client.lock.RUnlock()
+			if kept > 0 {
+				break
+			}
+		}
+		return "t2", nil
+	}, opt)
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if env.Data.Msg != "early" || env.AsyncID != taskKey("t2") {
+		t.Fatalf("want early of %s, get %+v", taskKey("t2"), env)
+	}
+	client.lock.RLock()
+	orphanCount := client.orphanCount
+	client.lock.RUnlock()
+	if orphanCount != 0 {
+		t.Fatalf("want orphans delivered, get %d", orphanCount)
+	}
+
+	// 回调中没有任务id
+	err = client.CallbackHandler(ctx, httptest.NewRequest(http.MethodPost, callbackURL, strings.NewReader(`{"msg":"ok"}`)))
+	if !errors.Is(err, ErrTaskIDMissing) {
+		t.Fatalf("want %v, get %v", ErrTaskIDMissing, err)
+	}
+
+	// 同一任务id不能重复等待
+	waitInfo, err := client.registTask("t3", 1)
+	if err != nil {
+		t.Fatalf("regist task failed: %v", err)
+	}
+	defer client.Release(waitInfo)
+	_, err = ToSyncTask[TestCallbackData](ctx, func(ctx context.Context) (string, error) {
+		return "t3", nil
+	}, opt)
+	if err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Fatalf("want already registered error, get %v", err)
+	}
+
+	// 未开启按任务id关联
+	other, _ := newTestClient(t, 1024*1024, 10)
+	_, err = ToSyncTask[TestCallbackData](ctx, func(ctx context.Context) (string, error) {
+		return "t4", nil
+	}, new(Option).SetClient(other))
+	if err == nil || !strings.Contains(err.Error(), "extractor not set") {
+		t.Fatalf("want extractor not set error, get %v", err)
+	}
+}
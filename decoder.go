@@ -0,0 +1,253 @@
+package tosync
+
+import (
+	"encoding"
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Decoder 把回调body解析到v中，v为指向CallbackData的指针
+type Decoder interface {
+	Decode(body []byte, v any) error
+}
+
+type DecoderFunc func(body []byte, v any) error
+
+func (f DecoderFunc) Decode(body []byte, v any) error {
+	return f(body, v)
+}
+
+var (
+	JSONDecoder Decoder = DecoderFunc(json.Unmarshal)
+	XMLDecoder  Decoder = DecoderFunc(xml.Unmarshal)
+	// FormDecoder 解析application/x-www-form-urlencoded，
+	// 支持url.Values、map[string][]string、map[string]string，以及按form标签（其次json标签）映射的struct
+	FormDecoder Decoder = DecoderFunc(decodeForm)
+	// RawDecoder 原样返回body，支持[]byte和string
+	RawDecoder Decoder = DecoderFunc(decodeRaw)
+	// ProtoDecoder 用于protobuf等二进制格式，CallbackData需要实现Unmarshal([]byte) error
+	// 或encoding.BinaryUnmarshaler
+	ProtoDecoder Decoder = DecoderFunc(decodeBinary)
+)
+
+// 按Content-Type选择的内置Decoder，未匹配时使用JSONDecoder
+var builtinDecoders = map[string]Decoder{
+	"application/json":                  JSONDecoder,
+	"text/json":                         JSONDecoder,
+	"application/xml":                   XMLDecoder,
+	"text/xml":                          XMLDecoder,
+	"application/x-www-form-urlencoded": FormDecoder,
+	"application/x-protobuf":            ProtoDecoder,
+	"application/protobuf":              ProtoDecoder,
+	"application/octet-stream":          RawDecoder,
+}
+
+// 选择Decoder：Option指定 > CallbackData为[]byte或string > client注册的Content-Type > 内置的Content-Type > json
+func (c *Client) decoderFor(opt *Option, contentType string, dataType reflect.Type) Decoder {
+	if opt.Decoder != nil {
+		return opt.Decoder
+	}
+	for dataType.Kind() == reflect.Pointer {
+		dataType = dataType.Elem()
+	}
+	if dataType.Kind() == reflect.String || (dataType.Kind() == reflect.Slice && dataType.Elem().Kind() == reflect.Uint8) {
+		return RawDecoder
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return JSONDecoder
+	}
+	if decoder, ok := c.decoders[mediaType]; ok {
+		return decoder
+	}
+	if decoder, ok := builtinDecoders[mediaType]; ok {
+		return decoder
+	}
+	switch {
+	case strings.HasSuffix(mediaType, "+json"):
+		return JSONDecoder
+	case strings.HasSuffix(mediaType, "+xml"):
+		return XMLDecoder
+	}
+	return JSONDecoder
+}
+
+// 解引用v，沿途为nil的指针会被初始化，返回可赋值的非指针值
+func indirect(v any) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return reflect.Value{}, errors.Errorf("decode into non-pointer %T", v)
+	}
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	return rv, nil
+}
+
+func decodeRaw(body []byte, v any) error {
+	rv, err := indirect(v)
+	if err != nil {
+		return err
+	}
+	switch {
+	case rv.Kind() == reflect.String:
+		rv.SetString(string(body))
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+		rv.SetBytes(append([]byte(nil), body...))
+	default:
+		return errors.Errorf("raw decoder not support %v", rv.Type())
+	}
+	return nil
+}
+
+func decodeBinary(body []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			if !rv.CanSet() {
+				break
+			}
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		switch u := rv.Interface().(type) {
+		case interface{ Unmarshal([]byte) error }:
+			return u.Unmarshal(body)
+		case encoding.BinaryUnmarshaler:
+			return u.UnmarshalBinary(body)
+		}
+		rv = rv.Elem()
+	}
+	return errors.Errorf("%T not implement Unmarshal([]byte) error", v)
+}
+
+func decodeForm(body []byte, v any) error {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return errors.Wrap(err, "parse form")
+	}
+	rv, err := indirect(v)
+	if err != nil {
+		return err
+	}
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		switch elem := rv.Type().Elem(); {
+		case elem.Kind() == reflect.String:
+			rv.Set(reflect.MakeMapWithSize(rv.Type(), len(values)))
+			for key := range values {
+				rv.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), reflect.ValueOf(values.Get(key)).Convert(elem))
+			}
+			return nil
+		case elem.Kind() == reflect.Slice && elem.Elem().Kind() == reflect.String:
+			// key、元素可能是自定义的string类型，逐个转换
+			rv.Set(reflect.MakeMapWithSize(rv.Type(), len(values)))
+			for key, vals := range values {
+				slice := reflect.MakeSlice(elem, len(vals), len(vals))
+				for i, val := range vals {
+					slice.Index(i).Set(reflect.ValueOf(val).Convert(elem.Elem()))
+				}
+				rv.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), slice)
+			}
+			return nil
+		}
+	case reflect.Struct:
+		return decodeFormStruct(values, rv)
+	}
+	return errors.Errorf("form decoder not support %v", rv.Type())
+}
+
+func decodeFormStruct(values url.Values, rv reflect.Value) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := formFieldName(field)
+		if name == "-" {
+			continue
+		}
+		vals, ok := values[name]
+		if !ok || len(vals) == 0 {
+			continue
+		}
+		err := setFormValue(rv.Field(i), vals)
+		if err != nil {
+			return errors.Wrapf(err, "field %s", field.Name)
+		}
+	}
+	return nil
+}
+
+func formFieldName(field reflect.StructField) string {
+	for _, key := range []string{"form", "json"} {
+		if tag, ok := field.Tag.Lookup(key); ok {
+			if name := strings.Split(tag, ",")[0]; name != "" {
+				return name
+			}
+		}
+	}
+	return field.Name
+}
+
+func setFormValue(fv reflect.Value, vals []string) error {
+	if fv.Kind() == reflect.Pointer {
+		fv.Set(reflect.New(fv.Type().Elem()))
+		fv = fv.Elem()
+	}
+	val := vals[0]
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(val, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() != reflect.String {
+			return errors.Errorf("not support %v", fv.Type())
+		}
+		slice := reflect.MakeSlice(fv.Type(), len(vals), len(vals))
+		for i, v := range vals {
+			slice.Index(i).SetString(v)
+		}
+		fv.Set(slice)
+	default:
+		return errors.Errorf("not support %v", fv.Type())
+	}
+	return nil
+}
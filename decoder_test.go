@@ -0,0 +1,148 @@
+package tosync
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testFormData struct {
+	TradeNo string   `form:"trade_no"`
+	Amount  int      `json:"amount"`
+	Paid    *bool    `form:"paid"`
+	Tags    []string `form:"tag"`
+	Ignored string   `form:"-"`
+}
+
+// 实现Unmarshal([]byte) error，模拟protobuf生成的类型
+type testBinaryData struct {
+	Raw string
+}
+
+func (d *testBinaryData) Unmarshal(buf []byte) error {
+	d.Raw = string(buf)
+	return nil
+}
+
+type testFormKey string
+
+type testFormValue string
+
+func TestDecoders(t *testing.T) {
+	body := []byte("trade_no=T1&amount=100&paid=true&tag=a&tag=b&Ignored=x")
+
+	var form testFormData
+	err := FormDecoder.Decode(body, &form)
+	if err != nil {
+		t.Fatalf("decode form failed: %v", err)
+	}
+	if form.TradeNo != "T1" || form.Amount != 100 || form.Paid == nil || !*form.Paid ||
+		!reflect.DeepEqual(form.Tags, []string{"a", "b"}) || form.Ignored != "" {
+		t.Fatalf("unexpected form %+v", form)
+	}
+
+	var formMap map[string]string
+	err = FormDecoder.Decode(body, &formMap)
+	if err != nil {
+		t.Fatalf("decode form failed: %v", err)
+	}
+	if formMap["trade_no"] != "T1" || formMap["tag"] != "a" {
+		t.Fatalf("unexpected form %v", formMap)
+	}
+
+	var values *url.Values
+	err = FormDecoder.Decode(body, &values)
+	if err != nil {
+		t.Fatalf("decode form failed: %v", err)
+	}
+	if (*values)["tag"][1] != "b" {
+		t.Fatalf("unexpected form %v", values)
+	}
+
+	// 自定义的key、元素类型
+	var named map[testFormKey][]testFormValue
+	err = FormDecoder.Decode(body, &named)
+	if err != nil {
+		t.Fatalf("decode form failed: %v", err)
+	}
+	if !reflect.DeepEqual(named["tag"], []testFormValue{"a", "b"}) {
+		t.Fatalf("unexpected form %v", named)
+	}
+
+	var raw string
+	err = RawDecoder.Decode([]byte("SUCCESS"), &raw)
+	if err != nil || raw != "SUCCESS" {
+		t.Fatalf("decode raw failed: %v %s", err, raw)
+	}
+
+	var bin *testBinaryData
+	err = ProtoDecoder.Decode([]byte{1, 2}, &bin)
+	if err != nil || bin.Raw != "\x01\x02" {
+		t.Fatalf("decode binary failed: %v %+v", err, bin)
+	}
+	err = ProtoDecoder.Decode([]byte{1, 2}, &raw)
+	if err == nil {
+		t.Fatal("expect error")
+	}
+
+	var xmlData struct {
+		ReturnCode string `xml:"return_code"`
+	}
+	err = XMLDecoder.Decode([]byte("<xml><return_code>SUCCESS</return_code></xml>"), &xmlData)
+	if err != nil || xmlData.ReturnCode != "SUCCESS" {
+		t.Fatalf("decode xml failed: %v %+v", err, xmlData)
+	}
+}
+
+func TestDecoderFor(t *testing.T) {
+	client := &Client{decoders: map[string]Decoder{"application/x-custom": RawDecoder}}
+	structType := reflect.TypeOf(TestCallbackData{})
+	cases := []struct {
+		opt         *Option
+		contentType string
+		dataType    reflect.Type
+		want        Decoder
+	}{
+		{new(Option), "application/json; charset=utf-8", structType, JSONDecoder},
+		{new(Option), "application/vnd.api+json", structType, JSONDecoder},
+		{new(Option), "text/xml", structType, XMLDecoder},
+		{new(Option), "application/x-www-form-urlencoded", structType, FormDecoder},
+		{new(Option), "application/x-custom", structType, RawDecoder},
+		{new(Option), "", structType, JSONDecoder},
+		{new(Option), "application/json", reflect.TypeOf(""), RawDecoder},
+		{new(Option), "application/json", reflect.TypeOf(new([]byte)), RawDecoder},
+		{new(Option).SetDecoder(XMLDecoder), "application/json", structType, XMLDecoder},
+	}
+	for i, c := range cases {
+		get := client.decoderFor(c.opt, c.contentType, c.dataType)
+		if reflect.ValueOf(get).Pointer() != reflect.ValueOf(c.want).Pointer() {
+			t.Fatalf("case %d: unexpected decoder", i)
+		}
+	}
+}
+
+// 验证按Content-Type解析form回调
+func TestToSyncFormCallback(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	data, err := ToSync[*TestReq, testFormData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		go func() {
+			resp, err := http.Post(req.GetCallbackURL(), "application/x-www-form-urlencoded", strings.NewReader("trade_no=T1&amount=100"))
+			if err != nil {
+				t.Errorf("post callback failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return nil
+	}, new(Option).SetClient(client))
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.TradeNo != "T1" || data.Amount != 100 {
+		t.Fatalf("unexpected data %+v", data)
+	}
+}
@@ -0,0 +1,169 @@
+package tosync
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/zeromicro/go-zero/core/logc"
+)
+
+type DedupPolicy int
+
+const (
+	// DedupFirstWins 同一个async_id只发布第一次callback，重复的callback直接应答成功。
+	// 不能与需要多次回调的DoneWhen、ToStream一起使用
+	DedupFirstWins DedupPolicy = iota
+	// DedupLastWins 每次callback都发布，等待方未消费的旧结果会被新结果覆盖，
+	// DoneWhen、ToStream下可能跳过中间状态，但不会丢失终态
+	DedupLastWins
+)
+
+// Deduper 记录已收到callback的async_id，用于多实例间去重
+type Deduper interface {
+	// Mark 标记asyncID已收到callback，first表示是否第一次标记
+	Mark(ctx context.Context, asyncID string, ttl time.Duration) (first bool, err error)
+	// Unmark 撤销标记，发布失败时调用，让下游重试的callback还能被处理
+	Unmark(ctx context.Context, asyncID string) error
+}
+
+// RedisDeduper 基于SETNX的Deduper。每个async_id一个独立的key，
+// Cluster下各key按自身分布到不同slot，不要在prefix中使用hash tag，避免全部落到同一个节点
+type RedisDeduper struct {
+	cli    redis.UniversalClient
+	prefix string
+}
+
+func NewRedisDeduper(cli redis.UniversalClient, prefix string) *RedisDeduper {
+	return &RedisDeduper{
+		cli:    cli,
+		prefix: prefix,
+	}
+}
+
+func (d *RedisDeduper) Mark(ctx context.Context, asyncID string, ttl time.Duration) (bool, error) {
+	first, err := d.cli.SetNX(ctx, d.prefix+asyncID, 1, ttl).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "redis setnx")
+	}
+	return first, nil
+}
+
+func (d *RedisDeduper) Unmark(ctx context.Context, asyncID string) error {
+	err := d.cli.Del(ctx, d.prefix+asyncID).Err()
+	if err != nil {
+		return errors.Wrap(err, "redis del")
+	}
+	return nil
+}
+
+// 内存实现每次写入时最多检查的过期记录数
+const sweepBatch = 32
+
+// MemoryDeduper 进程内的Deduper，只适用于单实例部署
+type MemoryDeduper struct {
+	lock    sync.Mutex
+	expires map[string]time.Time
+}
+
+func NewMemoryDeduper() *MemoryDeduper {
+	return &MemoryDeduper{
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (d *MemoryDeduper) Mark(ctx context.Context, asyncID string, ttl time.Duration) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	d.sweep(now)
+	if expire, ok := d.expires[asyncID]; ok && !now.After(expire) {
+		return false, nil
+	}
+	d.expires[asyncID] = now.Add(ttl)
+	return true, nil
+}
+
+// 顺带清理过期的记录，每次最多检查sweepBatch条，避免记录很多时每次回调都扫描全部。
+// map的遍历起点是随机的，多次调用后会覆盖全部记录
+func (d *MemoryDeduper) sweep(now time.Time) {
+	checked := 0
+	for id, expire := range d.expires {
+		if checked >= sweepBatch {
+			return
+		}
+		checked++
+		if now.After(expire) {
+			delete(d.expires, id)
+		}
+	}
+}
+
+func (d *MemoryDeduper) Unmark(ctx context.Context, asyncID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.expires, asyncID)
+	return nil
+}
+
+// ClientStats client运行时的计数
+type ClientStats struct {
+	DuplicateCallbacks  uint64 // 收到的重复callback
+	SuppressedCallbacks uint64 // 因重复而未发布的callback
+	ReplacedResults     uint64 // LastWins时被覆盖的未消费结果
+}
+
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		DuplicateCallbacks:  atomic.LoadUint64(&c.stats.DuplicateCallbacks),
+		SuppressedCallbacks: atomic.LoadUint64(&c.stats.SuppressedCallbacks),
+		ReplacedResults:     atomic.LoadUint64(&c.stats.ReplacedResults),
+	}
+}
+
+// 标记callback，返回是否需要跳过发布。去重失败时不拦截，重复callback的代价只是多处理一次
+func (c *Client) dedup(ctx context.Context, claims *callbackClaims) (skip bool) {
+	if c.deduper == nil {
+		return false
+	}
+	ttl := time.Until(time.Unix(claims.Expire, 0))
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	first, err := c.deduper.Mark(ctx, claims.AsyncID, ttl)
+	if err != nil {
+		logc.Errorf(ctx, "[ToSync] dedup mark async_id %s, error: %v", claims.AsyncID, err)
+		return false
+	}
+	if first {
+		return false
+	}
+	atomic.AddUint64(&c.stats.DuplicateCallbacks, 1)
+	if c.dedupPolicy == DedupFirstWins {
+		atomic.AddUint64(&c.stats.SuppressedCallbacks, 1)
+		return true
+	}
+	return false
+}
+
+// DoneWhen、ToStream需要同一个async_id的多次回调，FirstWins会丢弃第一次之后的全部回调，
+// 等待方收不到终态只能等到超时，因此不允许一起使用
+func (c *Client) checkMultiCallback() error {
+	if c.deduper != nil && c.dedupPolicy == DedupFirstWins {
+		return errors.New("multiple callbacks are suppressed by DedupFirstWins, use DedupLastWins")
+	}
+	return nil
+}
+
+func (c *Client) undedup(ctx context.Context, claims *callbackClaims) {
+	if c.deduper == nil {
+		return
+	}
+	err := c.deduper.Unmark(ctx, claims.AsyncID)
+	if err != nil {
+		logc.Errorf(ctx, "[ToSync] dedup unmark async_id %s, error: %v", claims.AsyncID, err)
+	}
+}
@@ -0,0 +1,128 @@
+package tosync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryDeduper(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDeduper()
+	first, err := d.Mark(ctx, "a", time.Minute)
+	if err != nil || !first {
+		t.Fatalf("want first, get %v %v", first, err)
+	}
+	first, err = d.Mark(ctx, "a", time.Minute)
+	if err != nil || first {
+		t.Fatalf("want duplicated, get %v %v", first, err)
+	}
+	err = d.Unmark(ctx, "a")
+	if err != nil {
+		t.Fatalf("unmark failed: %v", err)
+	}
+	first, err = d.Mark(ctx, "a", time.Millisecond)
+	if err != nil || !first {
+		t.Fatalf("want first, get %v %v", first, err)
+	}
+	// 过期后重新计为第一次
+	time.Sleep(time.Millisecond * 5)
+	first, err = d.Mark(ctx, "a", time.Minute)
+	if err != nil || !first {
+		t.Fatalf("want first, get %v %v", first, err)
+	}
+}
+
+func TestMemoryDeduperSweep(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDeduper()
+	for i := 0; i < sweepBatch*4; i++ {
+		d.Mark(ctx, strconv.Itoa(i), time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 5)
+	// 每次只清理一批，多次写入后过期记录被全部清掉
+	d.Mark(ctx, "a", time.Minute)
+	if n := len(d.expires); n <= 1 || n > sweepBatch*4+1-sweepBatch {
+		t.Fatalf("want one batch swept, get %d left", n)
+	}
+	for i := 0; i < 100 && len(d.expires) > 1; i++ {
+		d.Mark(ctx, "a", time.Minute)
+	}
+	if n := len(d.expires); n != 1 {
+		t.Fatalf("want 1 left, get %d", n)
+	}
+}
+
+func TestClientDedup(t *testing.T) {
+	ctx := context.Background()
+	claims := &callbackClaims{
+		AsyncID: "async_id",
+		Expire:  time.Now().Add(time.Minute).Unix(),
+	}
+
+	// FirstWins：重复的跳过
+	client := &Client{deduper: NewMemoryDeduper(), dedupPolicy: DedupFirstWins}
+	if client.dedup(ctx, claims) {
+		t.Fatal("first callback should not skip")
+	}
+	if !client.dedup(ctx, claims) {
+		t.Fatal("duplicated callback should skip")
+	}
+	if stats := client.Stats(); stats.DuplicateCallbacks != 1 || stats.SuppressedCallbacks != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// LastWins：重复的也发布，未消费的旧结果被覆盖
+	client = &Client{
+		deduper:     NewMemoryDeduper(),
+		dedupPolicy: DedupLastWins,
+		waiters: map[string]*WaiterInfo{
+			"async_id": {AsyncID: "async_id", ResultC: make(chan *CallbackInfoParsed, 1)},
+		},
+	}
+	for _, body := range []string{"old", "new"} {
+		if client.dedup(ctx, claims) {
+			t.Fatal("last wins should not skip")
+		}
+		buf, _ := json.Marshal(&CallbackInfo{
+			AsyncID:    "async_id",
+			Base64Body: base64.StdEncoding.EncodeToString([]byte(body)),
+		})
+		_, err := client.processMsg(body, buf)
+		if err != nil {
+			t.Fatalf("process msg failed: %v", err)
+		}
+	}
+	result := <-client.waiters["async_id"].ResultC
+	if string(result.Body) != "new" {
+		t.Fatalf("want new, get %s", result.Body)
+	}
+	if stats := client.Stats(); stats.DuplicateCallbacks != 1 || stats.SuppressedCallbacks != 0 || stats.ReplacedResults != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// FirstWins会丢弃终态回调，不能用于DoneWhen、ToStream
+func TestDedupFirstWinsMultiCallback(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10, new(ClientOption).SetDeduper(NewMemoryDeduper(), DedupFirstWins))
+	async := func(ctx context.Context, req *TestReq) error {
+		return nil
+	}
+	_, err := ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, async, new(Option).SetClient(client), DoneWhen(func(data TestCallbackData) (bool, error) {
+		return true, nil
+	}))
+	if err == nil || !strings.Contains(err.Error(), "DedupFirstWins") {
+		t.Fatalf("want DedupFirstWins error, get %v", err)
+	}
+	_, err = ToStream[*TestReq, TestCallbackData](ctx, &TestReq{}, async, func(data TestCallbackData) bool {
+		return true
+	}, new(Option).SetClient(client))
+	if err == nil || !strings.Contains(err.Error(), "DedupFirstWins") {
+		t.Fatalf("want DedupFirstWins error, get %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package tosync
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Envelope 回调数据及回调请求的元信息
+type Envelope[CallbackData any] struct {
+	AsyncID     string
+	Data        CallbackData
+	Body        []byte // 原始body
+	ContentType string
+	Method      string
+	Header      http.Header // 只含Config.ForwardHeaders中的header
+	Query       url.Values  // 只含Config.ForwardQuery中的参数
+	RemoteAddr  string
+}
+
+// 按白名单提取回调请求的header
+func (c *Client) forwardHeader(r *http.Request) map[string][]string {
+	if len(c.forwardHeaders) == 0 {
+		return nil
+	}
+	header := make(map[string][]string)
+	for _, key := range c.forwardHeaders {
+		if key == "*" {
+			return r.Header.Clone()
+		}
+		key = http.CanonicalHeaderKey(key)
+		if values, ok := r.Header[key]; ok {
+			header[key] = values
+		}
+	}
+	return header
+}
+
+// 按白名单提取回调请求的query参数，签名参数不转发
+func (c *Client) forwardQuery(r *http.Request) map[string][]string {
+	if len(c.forwardQueries) == 0 {
+		return nil
+	}
+	all := r.URL.Query()
+	query := make(map[string][]string)
+	for _, key := range c.forwardQueries {
+		if key == "*" {
+			for k, values := range all {
+				if !claimParams[k] {
+					query[k] = values
+				}
+			}
+			return query
+		}
+		if values, ok := all[key]; ok && !claimParams[key] {
+			query[key] = values
+		}
+	}
+	return query
+}
@@ -0,0 +1,48 @@
+package tosync
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// 验证回调的元信息
+func TestToSyncRaw(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	client.forwardHeaders = []string{"x-vendor-sign"}
+	client.forwardQueries = []string{"*"}
+
+	env, err := ToSyncRaw[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		go func() {
+			r, _ := http.NewRequest(http.MethodPut, req.GetCallbackURL()+"&trade_no=T1", strings.NewReader(`{"msg":"done"}`))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("X-Vendor-Sign", "abc")
+			r.Header.Set("X-Other", "ignored")
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Errorf("callback failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return nil
+	}, new(Option).SetClient(client))
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if env.Data.Msg != "done" || string(env.Body) != `{"msg":"done"}` {
+		t.Fatalf("unexpected data %+v", env)
+	}
+	if env.Method != http.MethodPut || env.ContentType != "application/json" || env.RemoteAddr == "" || env.AsyncID == "" {
+		t.Fatalf("unexpected meta %+v", env)
+	}
+	if env.Header.Get("X-Vendor-Sign") != "abc" || env.Header.Get("X-Other") != "" {
+		t.Fatalf("unexpected header %v", env.Header)
+	}
+	// 签名参数不转发
+	if env.Query.Get("trade_no") != "T1" || env.Query.Get("sign") != "" || env.Query.Get("async_id") != "" {
+		t.Fatalf("unexpected query %v", env.Query)
+	}
+}
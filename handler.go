@@ -0,0 +1,74 @@
+package tosync
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/zeromicro/go-zero/core/logc"
+)
+
+const (
+	defaultAckBody    = "success"
+	retryAfterSeconds = "1"
+)
+
+// HTTPHandler 返回可直接挂到路由上的callback处理器，响应格式由注册时选择的AckResponder决定，
+// 未选择时使用默认的AckResponder：成功时返回配置的AckBody，失败时按错误类型返回对应的状态码
+func (c *Client) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := c.CallbackHandler(r.Context(), r)
+		if err != nil {
+			logc.Errorf(r.Context(), "[ToSync] handle callback %s, error: %v", r.URL.Path, err)
+		}
+		c.ackResponder(c.parseClaims(r).Ack).Respond(w, r, err)
+	})
+}
+
+// 按名字选择AckResponder，名字未注册时用默认的
+func (c *Client) ackResponder(name string) AckResponder {
+	if responder, ok := c.ackResponders[name]; ok {
+		return responder
+	}
+	return c.ackResponders[""]
+}
+
+// HTTPHandler 默认client的callback处理器，需要先Init
+func HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := getDefaultClient()
+		if client == nil {
+			http.Error(w, "client not inited", http.StatusServiceUnavailable)
+			return
+		}
+		client.HTTPHandler().ServeHTTP(w, r)
+	})
+}
+
+// 错误类型到状态码的映射，发布失败和client关闭时让对方稍后重试
+func callbackStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidSign):
+		return http.StatusForbidden
+	case errors.Is(err, ErrSignExpired):
+		return http.StatusGone
+	case errors.Is(err, ErrInvalidVendorSign):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrTaskIDMissing):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrPublish), errors.Is(err, ErrClientClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// 回调方不可信，只返回状态码对应的短语，错误详情只记日志（可能含redis地址、回调body等）
+func writeCallbackError(w http.ResponseWriter, err error) {
+	status := callbackStatus(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", retryAfterSeconds)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,83 @@
+package tosync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCallbackStatus(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{ErrInvalidSign, http.StatusForbidden},
+		{errors.Wrap(ErrSignExpired, "expired"), http.StatusGone},
+		{errors.Wrap(ErrInvalidVendorSign, "hmac mismatch"), http.StatusUnauthorized},
+		{errors.Wrap(ErrTaskIDMissing, "path task_id not found"), http.StatusBadRequest},
+		{errors.Wrapf(ErrBodyTooLarge, "body limited to %d bytes", 10), http.StatusRequestEntityTooLarge},
+		{errors.Wrapf(ErrPublish, "pub: %v", "timeout"), http.StatusServiceUnavailable},
+		{ErrClientClosed, http.StatusServiceUnavailable},
+		{errors.New("unknown"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		if get := callbackStatus(c.err); get != c.want {
+			t.Fatalf("%v: want %d, get %d", c.err, c.want, get)
+		}
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	client, callbackURL := newTestClient(t, 10, 10)
+	handler := client.HTTPHandler()
+
+	// sign不对
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, callbackURL, strings.NewReader("{}")))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("want %d, get %d", http.StatusForbidden, w.Code)
+	}
+	// 不把内部错误返回给回调方
+	if get := strings.TrimSpace(w.Body.String()); get != http.StatusText(http.StatusForbidden) {
+		t.Fatalf("want %s, get %s", http.StatusText(http.StatusForbidden), get)
+	}
+
+	// body过大
+	target, err := client.signedURL("async_id", new(Option))
+	if err != nil {
+		t.Fatalf("sign url failed: %v", err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, strings.NewReader("12345678901")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("want %d, get %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	// 成功，默认响应success
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, strings.NewReader("{}")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, get %d", http.StatusOK, w.Code)
+	}
+	if get := w.Body.String(); get != defaultAckBody {
+		t.Fatalf("want %s, get %s", defaultAckBody, get)
+	}
+
+	// client关闭后让对方稍后重试
+	client.Close(context.Background())
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, strings.NewReader("{}")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("want %d, get %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if get := w.Header().Get("Retry-After"); get != retryAfterSeconds {
+		t.Fatalf("want Retry-After %s, get %q", retryAfterSeconds, get)
+	}
+	if get := strings.TrimSpace(w.Body.String()); get != http.StatusText(http.StatusServiceUnavailable) {
+		t.Fatalf("want %s, get %s", http.StatusText(http.StatusServiceUnavailable), get)
+	}
+}
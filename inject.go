@@ -0,0 +1,95 @@
+package tosync
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 标记callbackURL字段的tag，如 `tosync:"callback_url"`
+const (
+	tagName        = "tosync"
+	tagCallbackURL = "callback_url"
+)
+
+// InjectCallbackURL 把callbackURL填入v中带有`tosync:"callback_url"`tag的字段，
+// 字段类型为string或*string，可以在嵌套的结构体（含指针，为nil时自动创建）中。
+// v需要是结构体指针，且只能有一个这样的字段，字段原值需要为空
+func InjectCallbackURL(v any, callbackURL string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.Errorf("%T should be a non-nil struct pointer", v)
+	}
+	paths := callbackURLPaths(rv.Elem().Type(), nil, map[reflect.Type]bool{})
+	if len(paths) == 0 {
+		return errors.Errorf("no field tagged %s:%q in %T", tagName, tagCallbackURL, v)
+	}
+	if len(paths) > 1 {
+		return errors.Errorf("%d fields tagged %s:%q in %T, want one", len(paths), tagName, tagCallbackURL, v)
+	}
+
+	field := rv.Elem()
+	for _, index := range paths[0] {
+		if field.Kind() == reflect.Pointer {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		field = field.Field(index)
+	}
+	if field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		field = field.Elem()
+	}
+	// 不能带有callbackURL，因为要走统一的
+	if field.String() != "" {
+		return errors.New("callbackURL should be empty")
+	}
+	field.SetString(callbackURL)
+	return nil
+}
+
+// 找出t中所有带callbackURL tag的字段路径，visiting防止递归类型死循环
+func callbackURLPaths(t reflect.Type, prefix []int, visiting map[reflect.Type]bool) (paths [][]int) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visiting[t] {
+		return nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		path := append(append([]int(nil), prefix...), i)
+		if isCallbackURLTag(field.Tag.Get(tagName)) {
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.String {
+				paths = append(paths, path)
+			}
+			continue
+		}
+		paths = append(paths, callbackURLPaths(field.Type, path, visiting)...)
+	}
+	return
+}
+
+func isCallbackURLTag(tag string) bool {
+	for _, item := range strings.Split(tag, ",") {
+		if strings.TrimSpace(item) == tagCallbackURL {
+			return true
+		}
+	}
+	return false
+}
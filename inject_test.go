@@ -0,0 +1,80 @@
+package tosync
+
+import (
+	"testing"
+)
+
+type injectNotify struct {
+	URL string `json:"url" tosync:"callback_url"`
+}
+
+type injectReq struct {
+	Name   string
+	Notify *injectNotify
+}
+
+type injectPtrReq struct {
+	Hook *string `tosync:"callback_url,omitempty"`
+}
+
+type injectDupReq struct {
+	A string `tosync:"callback_url"`
+	B struct {
+		C string `tosync:"callback_url"`
+	}
+}
+
+type injectLoopReq struct {
+	Next *injectLoopReq
+	URL  string `tosync:"callback_url"`
+}
+
+func TestInjectCallbackURL(t *testing.T) {
+	// 嵌套的nil指针自动创建
+	req := &injectReq{}
+	err := InjectCallbackURL(req, "http://localhost/callback")
+	if err != nil {
+		t.Fatalf("inject failed: %v", err)
+	}
+	if req.Notify == nil || req.Notify.URL != "http://localhost/callback" {
+		t.Fatalf("callbackURL not injected: %+v", req.Notify)
+	}
+
+	// 已有callbackURL
+	err = InjectCallbackURL(req, "http://localhost/callback")
+	if err == nil {
+		t.Fatal("want error for non-empty callbackURL")
+	}
+
+	// *string字段
+	ptrReq := &injectPtrReq{}
+	err = InjectCallbackURL(ptrReq, "http://localhost/callback")
+	if err != nil {
+		t.Fatalf("inject failed: %v", err)
+	}
+	if ptrReq.Hook == nil || *ptrReq.Hook != "http://localhost/callback" {
+		t.Fatalf("callbackURL not injected: %v", ptrReq.Hook)
+	}
+
+	// 递归类型
+	loopReq := &injectLoopReq{}
+	err = InjectCallbackURL(loopReq, "http://localhost/callback")
+	if err != nil {
+		t.Fatalf("inject failed: %v", err)
+	}
+	if loopReq.URL != "http://localhost/callback" || loopReq.Next != nil {
+		t.Fatalf("callbackURL not injected: %+v", loopReq)
+	}
+
+	// 不合法的参数
+	for _, v := range []any{
+		injectReq{},
+		(*injectReq)(nil),
+		&TestCallbackData{},
+		&injectDupReq{},
+	} {
+		if err := InjectCallbackURL(v, "http://localhost/callback"); err == nil {
+			t.Fatalf("%T: want error", v)
+		}
+	}
+}
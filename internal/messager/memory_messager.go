@@ -0,0 +1,125 @@
+package messager
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryMsg struct {
+	id   *MsgID
+	data []byte
+}
+
+// MemoryStream 进程内的消息流，同一个stream上的所有MemoryMessager都能消费到全部消息
+type MemoryStream struct {
+	lock   sync.Mutex
+	seq    int64
+	msgs   []*memoryMsg
+	notify chan struct{} // 有新消息时关闭并替换，唤醒阻塞中的消费者
+}
+
+func NewMemoryStream() *MemoryStream {
+	return &MemoryStream{
+		notify: make(chan struct{}),
+	}
+}
+
+func (s *MemoryStream) pub(data []byte) *MsgID {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seq++
+	id := &MsgID{
+		MsTimestamp: time.Now().UnixNano() / 1e6,
+		Seq:         s.seq,
+	}
+	s.msgs = append(s.msgs, &memoryMsg{
+		id:   id,
+		data: append([]byte(nil), data...),
+	})
+
+	// 移除超出保留时间的消息
+	minTs := id.Add(-MsgRetainDur).MsTimestamp
+	i := 0
+	for i < len(s.msgs) && s.msgs[i].id.MsTimestamp < minTs {
+		i++
+	}
+	s.msgs = s.msgs[i:]
+
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return id
+}
+
+// 读取seq之后的最多count条消息，没有消息时返回用于等待的notify
+func (s *MemoryStream) read(seq int64, count int) ([]*memoryMsg, chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var result []*memoryMsg
+	for _, msg := range s.msgs {
+		if msg.id.Seq <= seq {
+			continue
+		}
+		result = append(result, msg)
+		if len(result) >= count {
+			break
+		}
+	}
+	return result, s.notify
+}
+
+func (s *MemoryStream) lastSeq() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.seq
+}
+
+// MemoryMessager MemoryStream上的一个消费者，维护自己的消费水位
+type MemoryMessager struct {
+	lock      sync.Mutex
+	stream    *MemoryStream
+	lastSubID int64
+}
+
+// NewMemoryMessager 从stream的当前位置开始消费
+func NewMemoryMessager(stream *MemoryStream) *MemoryMessager {
+	return &MemoryMessager{
+		stream:    stream,
+		lastSubID: stream.lastSeq(),
+	}
+}
+
+func (m *MemoryMessager) Pub(ctx context.Context, data []byte) (msgID string, err error) {
+	return m.stream.pub(data).String(), nil
+}
+
+// result: msgID -> data
+func (m *MemoryMessager) DupSub(ctx context.Context) (result map[string][]byte, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	timer := time.NewTimer(ReadBlockDur)
+	defer timer.Stop()
+	for {
+		msgs, notify := m.stream.read(m.lastSubID, 5)
+		if len(msgs) > 0 {
+			result = make(map[string][]byte, len(msgs))
+			for _, msg := range msgs {
+				result[msg.id.String()] = msg.data
+				m.lastSubID = msg.id.Seq
+			}
+			return result, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return make(map[string][]byte), nil
+		case <-notify:
+		}
+	}
+}
+
+func (m *MemoryMessager) Ack(ctx context.Context, msgID string) error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package messager
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/huaiyann/congroup/v2"
+	"github.com/pkg/errors"
+)
+
+func TestMemoryMessagerPubSub(t *testing.T) {
+	ctx := context.Background()
+	stream := NewMemoryStream()
+	// 同一stream上的多个消费者都能收到全部消息
+	msgers := []*MemoryMessager{NewMemoryMessager(stream), NewMemoryMessager(stream)}
+	ReadBlockDur = time.Millisecond * 200
+
+	getMsgs := make([]map[string][]byte, len(msgers))
+	cg := congroup.New(ctx)
+	for i := range msgers {
+		i := i
+		getMsgs[i] = make(map[string][]byte)
+		cg.Add(func(ctx context.Context) error {
+			for nullCnt := 0; nullCnt < 2; {
+				data, err := msgers[i].DupSub(ctx)
+				if err != nil {
+					return errors.Wrap(err, "dup sub failed")
+				}
+				for msgID, msgData := range data {
+					getMsgs[i][msgID] = msgData
+				}
+				if len(data) == 0 {
+					nullCnt++
+				}
+			}
+			return nil
+		})
+	}
+
+	wantMsg := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		data := []byte(uuid.NewString())
+		msgID, err := msgers[i%2].Pub(ctx, data)
+		if err != nil {
+			t.Fatalf("pub failed: %v", err)
+		}
+		wantMsg[msgID] = data
+	}
+
+	err := cg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, getMsg := range getMsgs {
+		if !reflect.DeepEqual(wantMsg, getMsg) {
+			t.Fatalf("messager %d: want msg cnt %v, get msg cnt %v", i, len(wantMsg), len(getMsg))
+		}
+	}
+}
+
+func TestMemoryMessagerStartFromLatest(t *testing.T) {
+	ctx := context.Background()
+	stream := NewMemoryStream()
+	old := NewMemoryMessager(stream)
+	_, err := old.Pub(ctx, []byte("old"))
+	if err != nil {
+		t.Fatalf("pub failed: %v", err)
+	}
+
+	// 新消费者不会收到创建前的消息
+	ReadBlockDur = time.Millisecond * 100
+	msger := NewMemoryMessager(stream)
+	data, err := msger.DupSub(ctx)
+	if err != nil {
+		t.Fatalf("dup sub failed: %v", err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("want no msg, get %d", len(data))
+	}
+
+	// ctx结束时立即返回
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = msger.DupSub(cancelCtx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, get %v", context.Canceled, err)
+	}
+}
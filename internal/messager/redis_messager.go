@@ -56,22 +56,36 @@ func ParseMsgID(s string) (*MsgID, error) {
 	}, nil
 }
 
+// RedisOption stream的保留策略
+type RedisOption struct {
+	MaxAge       time.Duration // 按时间保留，基于redis server生成的消息id，<=0时使用MsgRetainDur
+	MaxLen       int64         // 按长度保留，近似修剪，<=0时不限制
+	TrimInterval time.Duration // 后台定时修剪的间隔，没有新消息时也能清理，<=0时不开启
+}
+
 type RedisMessager struct {
 	lock      *sync.RWMutex
-	cli       *redis.Client
+	cli       redis.UniversalClient
 	stream    string
+	opt       RedisOption
 	lastPubID *MsgID
 	lastSubID *MsgID
+
+	cancel      context.CancelFunc // 停止后台修剪
+	trimmerDone chan struct{}
 }
 
-func NewRedisMessager(cli *redis.Client, stream string) (*RedisMessager, error) {
+// NewRedisMessager 支持单机、Cluster、Sentinel、Ring等任意redis.UniversalClient。
+// 用到的命令（XADD、XREAD、TIME）都只涉及stream这一个key，
+// Cluster下不需要hash tag；stream key自带的{tag}会原样保留
+func NewRedisMessager(cli redis.UniversalClient, stream string, opts ...*RedisOption) (*RedisMessager, error) {
 	// 每次从最新开始消费，用redis server的时间戳（减一个dur）作为初始水位
 	t, err := cli.Time(context.Background()).Result()
 	if err != nil {
 		return nil, errors.Wrap(err, "get redis time")
 	}
 	t = t.Add(-time.Second)
-	return &RedisMessager{
+	r := &RedisMessager{
 		lock:   &sync.RWMutex{},
 		cli:    cli,
 		stream: stream,
@@ -79,7 +93,36 @@ func NewRedisMessager(cli *redis.Client, stream string) (*RedisMessager, error)
 			MsTimestamp: t.UnixNano() / 1e6,
 			Seq:         0,
 		},
-	}, nil
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			r.opt = *opt
+		}
+	}
+	if r.opt.TrimInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		r.cancel = cancel
+		r.trimmerDone = make(chan struct{})
+		go r.trimLoop(ctx)
+	}
+	return r, nil
+}
+
+func (r *RedisMessager) maxAge() time.Duration {
+	if r.opt.MaxAge > 0 {
+		return r.opt.MaxAge
+	}
+	return MsgRetainDur
+}
+
+// 按时间保留的最小消息id，用的是redis服务器的时间（从消息id中解析），避免本地时钟不准
+func (r *RedisMessager) minID() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.lastPubID == nil || !r.lastPubID.Gt(new(MsgID)) {
+		return ""
+	}
+	return r.lastPubID.Add(-r.maxAge()).String()
 }
 
 func (r *RedisMessager) Pub(ctx context.Context, data []byte) (msgID string, err error) {
@@ -90,14 +133,33 @@ func (r *RedisMessager) Pub(ctx context.Context, data []byte) (msgID string, err
 		},
 		Approx: true,
 	}
-	// if r.lastPubID != nil && r.lastPubID.Gt(new(MsgID)) {
-	// 	// 移除队列中超出时间限制的消息，但用的时间是redis服务器的（从消息id中解析），避免本地时钟不准
-	// 	item.MinID = r.lastPubID.Add(-MsgRetainDur).String()
-	// }
-	msgID, err = r.cli.XAdd(ctx, item).Result()
+	// 移除队列中超出限制的消息，xadd只能带一种修剪条件，两种都配置时另外按时间修剪
+	minID := r.minID()
+	if r.opt.MaxLen > 0 {
+		item.MaxLen = r.opt.MaxLen
+	} else {
+		item.MinID = minID
+	}
+	var addCmd *redis.StringCmd
+	var trimCmd *redis.IntCmd
+	if r.opt.MaxLen > 0 && minID != "" {
+		// 与xadd放在同一个pipeline中，不增加往返次数
+		pipe := r.cli.Pipeline()
+		addCmd = pipe.XAdd(ctx, item)
+		trimCmd = pipe.XTrimMinIDApprox(ctx, r.stream, minID, 0)
+		pipe.Exec(ctx) // 错误在各命令的结果中分别处理
+	} else {
+		addCmd = r.cli.XAdd(ctx, item)
+	}
+	msgID, err = addCmd.Result()
 	if err != nil {
 		return "", errors.Wrapf(err, "redis xadd, args: %+v", item)
 	}
+	if trimCmd != nil {
+		if terr := trimCmd.Err(); terr != nil {
+			logc.Errorf(ctx, "redis xtrim stream %s minid %s, error: %v", r.stream, minID, terr)
+		}
+	}
 
 	// 处理消息水位
 	newPubID, err := ParseMsgID(msgID)
@@ -169,3 +231,49 @@ func (r *RedisMessager) Ack(ctx context.Context, msgID string) error {
 	// xread不需要ack，只需要消费者自己维护消费水位
 	return nil
 }
+
+// Trim 按保留策略修剪stream，时间以redis server为准
+func (r *RedisMessager) Trim(ctx context.Context) error {
+	t, err := r.cli.Time(ctx).Result()
+	if err != nil {
+		return errors.Wrap(err, "get redis time")
+	}
+	minID := &MsgID{MsTimestamp: t.Add(-r.maxAge()).UnixNano() / 1e6}
+	err = r.cli.XTrimMinIDApprox(ctx, r.stream, minID.String(), 0).Err()
+	if err != nil {
+		return errors.Wrapf(err, "redis xtrim minid %s", minID)
+	}
+	if r.opt.MaxLen > 0 {
+		err = r.cli.XTrimMaxLenApprox(ctx, r.stream, r.opt.MaxLen, 0).Err()
+		if err != nil {
+			return errors.Wrapf(err, "redis xtrim maxlen %d", r.opt.MaxLen)
+		}
+	}
+	return nil
+}
+
+func (r *RedisMessager) trimLoop(ctx context.Context) {
+	defer close(r.trimmerDone)
+	ticker := time.NewTicker(r.opt.TrimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := r.Trim(ctx)
+			if err != nil && ctx.Err() == nil {
+				logc.Errorf(ctx, "trim stream %s, error: %v", r.stream, err)
+			}
+		}
+	}
+}
+
+// Close 停止后台修剪，不会关闭redis client
+func (r *RedisMessager) Close() error {
+	if r.cancel != nil {
+		r.cancel()
+		<-r.trimmerDone
+	}
+	return nil
+}
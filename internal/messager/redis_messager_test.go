@@ -137,3 +137,103 @@ func TestRedisMessagerTrim(t *testing.T) {
 		t.Fatalf("want stream len < 100, get %d", len)
 	}
 }
+
+func TestRedisMessagerUniversalClient(t *testing.T) {
+	ctx := context.Background()
+	cli := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs: []string{"localhost:6379"},
+	})
+	err := cli.Ping(ctx).Err()
+	if err != nil {
+		t.Fatalf("ping redis failed: %v", err)
+	}
+
+	tmpStream := "{test_stream}_" + uuid.NewString()
+	defer cli.Expire(ctx, tmpStream, time.Hour)
+	msger, err := NewRedisMessager(cli, tmpStream)
+	if err != nil {
+		t.Fatalf("new redis messager failed: %v", err)
+	}
+	data := []byte(uuid.NewString())
+	msgID, err := msger.Pub(ctx, data)
+	if err != nil {
+		t.Fatalf("pub failed: %v", err)
+	}
+	getMsg, err := msger.DupSub(ctx)
+	if err != nil {
+		t.Fatalf("dup sub failed: %v", err)
+	}
+	if !reflect.DeepEqual(getMsg[msgID], data) {
+		t.Fatalf("want %s, get %s", data, getMsg[msgID])
+	}
+}
+
+func TestRedisMessagerTrimMaxLen(t *testing.T) {
+	ctx := context.Background()
+	cli := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	err := cli.Ping(ctx).Err()
+	if err != nil {
+		t.Fatalf("ping redis failed: %v", err)
+	}
+
+	tmpStream := "test_stream_" + uuid.NewString()
+	defer cli.Expire(ctx, tmpStream, time.Hour)
+	msger, err := NewRedisMessager(cli, tmpStream, &RedisOption{MaxLen: 100})
+	if err != nil {
+		t.Fatalf("new redis messager failed: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		_, err = msger.Pub(ctx, []byte(uuid.NewString()))
+		if err != nil {
+			t.Fatalf("pub failed: %v", err)
+		}
+	}
+	// 因为是非精确修剪，长度应该小于300
+	len, err := cli.XLen(ctx, tmpStream).Result()
+	if err != nil {
+		t.Fatalf("get stream len failed: %v", err)
+	}
+	if len >= 300 {
+		t.Fatalf("want stream len < 300, get %d", len)
+	}
+}
+
+func TestRedisMessagerTrimInterval(t *testing.T) {
+	ctx := context.Background()
+	cli := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	err := cli.Ping(ctx).Err()
+	if err != nil {
+		t.Fatalf("ping redis failed: %v", err)
+	}
+
+	tmpStream := "test_stream_" + uuid.NewString()
+	defer cli.Expire(ctx, tmpStream, time.Hour)
+	msger, err := NewRedisMessager(cli, tmpStream, &RedisOption{
+		MaxAge:       time.Second,
+		TrimInterval: time.Millisecond * 200,
+	})
+	if err != nil {
+		t.Fatalf("new redis messager failed: %v", err)
+	}
+	defer msger.Close()
+	for i := 0; i < 200; i++ {
+		_, err = msger.Pub(ctx, []byte(uuid.NewString()))
+		if err != nil {
+			t.Fatalf("pub failed: %v", err)
+		}
+	}
+
+	// 不再生产消息，等待后台修剪
+	time.Sleep(time.Second * 2)
+	len, err := cli.XLen(ctx, tmpStream).Result()
+	if err != nil {
+		t.Fatalf("get stream len failed: %v", err)
+	}
+	if len >= 100 {
+		t.Fatalf("want stream len < 100, get %d", len)
+	}
+}
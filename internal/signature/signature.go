@@ -1,26 +1,85 @@
 package signature
 
 import (
-	"crypto/md5"
-	"crypto/sha512"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"math/rand"
-)
+	"hash"
 
-const (
-	signSalt = "GMswFuu1oyP3iNk9ceqiciLp6dBKs8hO"
+	"github.com/pkg/errors"
 )
 
-func GenSign(asyncID string) (random int64, sign string) {
-	random = rand.Int63n(10000000)
-	data := fmt.Sprintf("%s_%d_%s", asyncID, random, signSalt)
-	sign = fmt.Sprintf("%X", sha512.Sum512([]byte(data)))
-	return
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Signer 基于HMAC-SHA256签名，第一个key用于签名，全部key都可用于校验，便于密钥轮换
+type Signer struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewSigner(keys ...Key) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no sign key")
+	}
+	s := &Signer{
+		current: keys[0].ID,
+		keys:    make(map[string][]byte, len(keys)),
+	}
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("sign key id is empty")
+		}
+		if len(key.Secret) == 0 {
+			return nil, errors.Errorf("sign key %s secret is empty", key.ID)
+		}
+		if _, ok := s.keys[key.ID]; ok {
+			return nil, errors.Errorf("sign key %s duplicated", key.ID)
+		}
+		s.keys[key.ID] = key.Secret
+	}
+	return s, nil
+}
+
+// Sign 用当前key对fields签名，返回key id和hex编码的签名
+func (s *Signer) Sign(fields ...string) (keyID string, sign string) {
+	mac := hmac.New(sha256.New, s.keys[s.current])
+	writeFields(mac, fields)
+	return s.current, hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check 用keyID对应的key校验签名，比较是常数时间的
+func (s *Signer) Check(keyID string, sign string, fields ...string) bool {
+	secret, ok := s.keys[keyID]
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sign)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	writeFields(mac, fields)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// 每个字段带上长度前缀，避免字段拼接产生歧义
+func writeFields(h hash.Hash, fields []string) {
+	for _, field := range fields {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
 }
 
-func CheckSign(asyncID string, random string, sign string) bool {
-	data := fmt.Sprintf("%s_%s_%s", asyncID, random, signSalt)
-	wantOld := fmt.Sprintf("%X", md5.Sum([]byte(data)))
-	want := fmt.Sprintf("%X", sha512.Sum512([]byte(data)))
-	return wantOld == sign || want == sign
+// NewNonce 生成密码学安全的随机串
+func NewNonce() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", errors.Wrap(err, "read crypto rand")
+	}
+	return hex.EncodeToString(buf), nil
 }
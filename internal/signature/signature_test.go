@@ -0,0 +1,69 @@
+package signature
+
+import "testing"
+
+func TestSigner(t *testing.T) {
+	oldSigner, err := NewSigner(Key{ID: "k1", Secret: []byte("secret1")})
+	if err != nil {
+		t.Fatalf("new signer failed: %v", err)
+	}
+	newSigner, err := NewSigner(Key{ID: "k2", Secret: []byte("secret2")}, Key{ID: "k1", Secret: []byte("secret1")})
+	if err != nil {
+		t.Fatalf("new signer failed: %v", err)
+	}
+
+	keyID, sign := newSigner.Sign("async_id", "nonce")
+	if keyID != "k2" {
+		t.Fatalf("want key k2, get %s", keyID)
+	}
+	if !newSigner.Check(keyID, sign, "async_id", "nonce") {
+		t.Fatal("want sign ok")
+	}
+	// 参数被篡改
+	if newSigner.Check(keyID, sign, "async_id", "nonce2") {
+		t.Fatal("want sign failed")
+	}
+	// 字段边界被篡改
+	if newSigner.Check(keyID, sign, "async_idn", "once") {
+		t.Fatal("want sign failed")
+	}
+	// 未知key
+	if oldSigner.Check(keyID, sign, "async_id", "nonce") {
+		t.Fatal("want sign failed")
+	}
+
+	// 轮换后旧key签的仍然有效
+	keyID, sign = oldSigner.Sign("async_id", "nonce")
+	if !newSigner.Check(keyID, sign, "async_id", "nonce") {
+		t.Fatal("want sign ok")
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	_, err := NewSigner()
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	_, err = NewSigner(Key{ID: "k1", Secret: []byte("s")}, Key{ID: "k1", Secret: []byte("s")})
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	_, err = NewSigner(Key{ID: "k1"})
+	if err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestNewNonce(t *testing.T) {
+	a, err := NewNonce()
+	if err != nil {
+		t.Fatalf("new nonce failed: %v", err)
+	}
+	b, err := NewNonce()
+	if err != nil {
+		t.Fatalf("new nonce failed: %v", err)
+	}
+	if len(a) != 32 || a == b {
+		t.Fatalf("unexpected nonce %s %s", a, b)
+	}
+}
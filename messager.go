@@ -2,6 +2,8 @@ package tosync
 
 import (
 	"context"
+
+	"github.com/huaiyann/tosync/internal/messager"
 )
 
 type Messager interface {
@@ -10,3 +12,19 @@ type Messager interface {
 	DupSub(context.Context) (data map[string][]byte, err error)
 	Ack(ctx context.Context, msgID string) error
 }
+
+// MemoryStream 进程内的消息流，用于单实例部署和不依赖redis的测试
+type MemoryStream = messager.MemoryStream
+
+func NewMemoryStream() *MemoryStream {
+	return messager.NewMemoryStream()
+}
+
+// NewMemoryMessager 在stream上创建一个消费者，同一stream上的多个client之间互相广播，
+// stream为nil时新建一个。每个client需要使用各自的Messager
+func NewMemoryMessager(stream *MemoryStream) Messager {
+	if stream == nil {
+		stream = messager.NewMemoryStream()
+	}
+	return messager.NewMemoryMessager(stream)
+}
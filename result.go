@@ -0,0 +1,73 @@
+package tosync
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// CallbackResult 回调数据实现该接口时，ToSync用Err判断任务是否在回调中报告了失败
+type CallbackResult interface {
+	Err() error
+}
+
+// CallbackError 回调中报告了失败，Payload为解析后的回调数据
+type CallbackError struct {
+	AsyncID string
+	Payload any
+	Err     error
+}
+
+func (e *CallbackError) Error() string {
+	return fmt.Sprintf("callback of %s reports failure: %v", e.AsyncID, e.Err)
+}
+
+func (e *CallbackError) Unwrap() error {
+	return e.Err
+}
+
+// WithResultError 从回调数据中提取失败信息，如{"code":500,"err":"quota"}，
+// 返回非nil时ToSync返回*CallbackError。优先于CallbackResult接口
+func WithResultError[CallbackData any](fn func(CallbackData) error) *Option {
+	if fn == nil {
+		return &Option{}
+	}
+	return &Option{resultErr: fn}
+}
+
+// 取出WithResultError设置的函数，类型需要和CallbackData一致
+func resultErrFunc[CallbackData any](opt *Option) (func(CallbackData) error, error) {
+	if opt.resultErr == nil {
+		return nil, nil
+	}
+	fn, ok := opt.resultErr.(func(CallbackData) error)
+	if !ok {
+		var null CallbackData
+		return nil, errors.Errorf("WithResultError func %T not match CallbackData %T", opt.resultErr, null)
+	}
+	return fn, nil
+}
+
+// 判断回调数据是否报告了失败
+func checkResult[CallbackData any](asyncID string, data CallbackData, fn func(CallbackData) error) error {
+	var err error
+	if fn != nil {
+		err = fn(data)
+	} else if v := reflect.ValueOf(&data).Elem(); v.Kind() == reflect.Pointer && v.IsNil() {
+		// 回调为null时没有可判断的内容
+		return nil
+	} else if result, ok := any(data).(CallbackResult); ok {
+		err = result.Err()
+	} else if result, ok := any(&data).(CallbackResult); ok {
+		err = result.Err()
+	}
+	if err == nil {
+		return nil
+	}
+	return &CallbackError{
+		AsyncID: asyncID,
+		Payload: data,
+		Err:     err,
+	}
+}
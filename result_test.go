@@ -0,0 +1,95 @@
+package tosync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// 通过接口报告失败的回调
+type testResult struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+func (r *testResult) Err() error {
+	if r.Code != 0 {
+		return errors.New(r.Msg)
+	}
+	return nil
+}
+
+func TestCheckResult(t *testing.T) {
+	// 指针接收者，值类型也能识别
+	err := checkResult("id", testResult{Code: 500, Msg: "quota"}, nil)
+	var cbErr *CallbackError
+	if !errors.As(err, &cbErr) {
+		t.Fatalf("want CallbackError, get %v", err)
+	}
+	if cbErr.AsyncID != "id" || cbErr.Payload.(testResult).Msg != "quota" || cbErr.Err.Error() != "quota" {
+		t.Fatalf("unexpected error %+v", cbErr)
+	}
+
+	err = checkResult("id", &testResult{Code: 500, Msg: "quota"}, nil)
+	if !errors.As(err, &cbErr) {
+		t.Fatalf("want CallbackError, get %v", err)
+	}
+	if err = checkResult("id", &testResult{}, nil); err != nil {
+		t.Fatalf("want nil, get %v", err)
+	}
+	// 回调为null
+	if err = checkResult[*testResult]("id", nil, nil); err != nil {
+		t.Fatalf("want nil, get %v", err)
+	}
+
+	// 自定义函数优先
+	quota := errors.New("quota")
+	err = checkResult("id", map[string]any{"code": 500}, func(data map[string]any) error {
+		if data["code"] != 500 {
+			return nil
+		}
+		return quota
+	})
+	if !errors.Is(err, quota) {
+		t.Fatalf("want %v, get %v", quota, err)
+	}
+}
+
+// 验证ToSync返回回调中报告的失败
+func TestToSyncResultError(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client)
+	async := func(ctx context.Context, req *TestReq) error {
+		go func() {
+			buf, _ := json.Marshal(&testResult{Code: 500, Msg: "quota"})
+			resp, err := http.Post(req.GetCallbackURL(), "application/json", bytes.NewBuffer(buf))
+			if err != nil {
+				t.Errorf("post callback failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return nil
+	}
+
+	data, err := ToSync[*TestReq, *testResult](ctx, &TestReq{}, async, opt)
+	var cbErr *CallbackError
+	if !errors.As(err, &cbErr) {
+		t.Fatalf("want CallbackError, get %v", err)
+	}
+	if data.Code != 500 {
+		t.Fatalf("want data returned with error, get %+v", data)
+	}
+
+	_, err = ToSync[*TestReq, map[string]any](ctx, &TestReq{}, async, opt, WithResultError(func(data map[string]any) error {
+		return errors.Errorf("code %v", data["code"])
+	}))
+	if !errors.As(err, &cbErr) || cbErr.Err.Error() != "code 500" {
+		t.Fatalf("want CallbackError, get %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package tosync
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zeromicro/go-zero/core/logc"
+)
+
+// 重试策略的默认值
+const (
+	DefaultInitialBackoff = time.Millisecond * 100
+	DefaultMaxBackoff     = time.Second * 10
+	DefaultMultiplier     = 2.0
+)
+
+// RetryPolicy async返回错误时的重试策略。重试复用同一个async_id和callbackURL，
+// 之前某次提交被下游受理后晚到的回调同样有效：等待重试期间收到回调时直接以回调为准
+type RetryPolicy struct {
+	MaxAttempts    int              // 最多提交次数（含第一次），不大于1时不重试
+	InitialBackoff time.Duration    // 第一次重试前的等待，默认DefaultInitialBackoff
+	MaxBackoff     time.Duration    // 等待的上限，默认DefaultMaxBackoff
+	Multiplier     float64          // 每次重试等待时间的倍数，默认DefaultMultiplier
+	Jitter         float64          // 随机抖动比例，取值[0,1]，等待时间在backoff*(1±Jitter)之间
+	Retryable      func(error) bool // 判断错误是否可以重试，默认都重试
+}
+
+// 第attempt次提交失败后的等待时间
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = DefaultInitialBackoff
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = DefaultMultiplier
+	}
+
+	tmp := float64(backoff)
+	for i := 1; i < attempt && tmp < float64(maxBackoff); i++ {
+		tmp *= multiplier
+	}
+	if tmp > float64(maxBackoff) {
+		tmp = float64(maxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		tmp *= 1 + jitter*(rand.Float64()*2-1)
+	}
+	return time.Duration(tmp)
+}
+
+func (p *RetryPolicy) retryable(attempt int, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return true
+}
+
+// 按重试策略提交，等待重试期间收到回调时不再重试，视为提交成功
+func runWithRetry(ctx context.Context, client *Client, opt *Option, waitInfo *WaiterInfo, run func(context.Context, *WaiterInfo) error) (err error) {
+	policy := opt.Retry
+	for attempt := 1; ; attempt++ {
+		err = run(ctx, waitInfo)
+		if err == nil {
+			return
+		}
+		if !policy.retryable(attempt, err) {
+			if attempt > 1 {
+				err = errors.Wrapf(err, "after %d attempts", attempt)
+			}
+			return
+		}
+		// 之前的提交可能已被下游受理
+		if client.callbackArrived(waitInfo) {
+			logc.Infof(ctx, "[ToSync] async id %s callback arrived, stop retrying: %v", waitInfo.AsyncID, err)
+			return nil
+		}
+
+		backoff := policy.backoff(attempt)
+		logc.Infof(ctx, "[ToSync] async id %s attempt %d failed, retry after %v: %v", waitInfo.AsyncID, attempt, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = errors.Wrapf(err, "retry interrupted after %d attempts", attempt)
+			return
+		case callbackInfo := <-waitInfo.ResultC:
+			timer.Stop()
+			// 放回去交给等待方
+			select {
+			case waitInfo.ResultC <- callbackInfo:
+			default:
+			}
+			logc.Infof(ctx, "[ToSync] async id %s callback arrived during backoff, stop retrying", waitInfo.AsyncID)
+			return nil
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package tosync
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &RetryPolicy{
+		InitialBackoff: time.Millisecond * 10,
+		MaxBackoff:     time.Millisecond * 30,
+		Multiplier:     2,
+	}
+	for attempt, want := range map[int]time.Duration{
+		1: time.Millisecond * 10,
+		2: time.Millisecond * 20,
+		3: time.Millisecond * 30,
+		4: time.Millisecond * 30,
+	} {
+		if get := policy.backoff(attempt); get != want {
+			t.Fatalf("attempt %d: want %v, get %v", attempt, want, get)
+		}
+	}
+
+	// 默认值
+	if get := new(RetryPolicy).backoff(1); get != DefaultInitialBackoff {
+		t.Fatalf("want %v, get %v", DefaultInitialBackoff, get)
+	}
+
+	// 抖动
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		get := policy.backoff(1)
+		if get < time.Millisecond*5 || get > time.Millisecond*15 {
+			t.Fatalf("want in [5ms, 15ms], get %v", get)
+		}
+	}
+}
+
+func TestToSyncRetry(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client)
+	transient := errors.New("transient")
+	policy := &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond * 10,
+	}
+
+	// 失败两次后成功，每次使用同一个callbackURL
+	var lock sync.Mutex
+	var urls []string
+	data, err := ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		lock.Lock()
+		urls = append(urls, req.GetCallbackURL())
+		attempts := len(urls)
+		lock.Unlock()
+		if attempts < 3 {
+			return transient
+		}
+		go func() {
+			resp, err := http.Post(req.GetCallbackURL(), "application/json", strings.NewReader(`{"msg":"ok"}`))
+			if err != nil {
+				t.Errorf("post callback failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return nil
+	}, opt, new(Option).SetRetry(policy))
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "ok" {
+		t.Fatalf("want ok, get %s", data.Msg)
+	}
+	if len(urls) != 3 || urls[0] != urls[1] || urls[1] != urls[2] {
+		t.Fatalf("want 3 attempts with same callbackURL, get %v", urls)
+	}
+
+	// 超过最大次数
+	attempts := 0
+	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		attempts++
+		return transient
+	}, opt, new(Option).SetRetry(policy))
+	if !errors.Is(err, transient) || attempts != 3 || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Fatalf("want %v after 3 attempts, get %v with %d attempts", transient, err, attempts)
+	}
+
+	// 不可重试的错误
+	attempts = 0
+	fatal := errors.New("fatal")
+	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		attempts++
+		return fatal
+	}, opt, new(Option).SetRetry(&RetryPolicy{
+		MaxAttempts: 3,
+		Retryable: func(err error) bool {
+			return !errors.Is(err, fatal)
+		},
+	}))
+	if !errors.Is(err, fatal) || attempts != 1 {
+		t.Fatalf("want %v with 1 attempt, get %v with %d attempts", fatal, err, attempts)
+	}
+
+	// 第一次提交超时但被下游受理，回调在等待重试期间到达
+	attempts = 0
+	data, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		attempts++
+		go func() {
+			time.Sleep(time.Millisecond * 50)
+			resp, err := http.Post(req.GetCallbackURL(), "application/json", strings.NewReader(`{"msg":"late"}`))
+			if err != nil {
+				t.Errorf("post callback failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return transient
+	}, opt, new(Option).SetRetry(&RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+	}))
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "late" || attempts != 1 {
+		t.Fatalf("want late with 1 attempt, get %s with %d attempts", data.Msg, attempts)
+	}
+}
+
+// 流式转换同样按Option重试
+func TestToStreamRetry(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	transient := errors.New("transient")
+
+	attempts := 0
+	events, err := ToStream[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		attempts++
+		if attempts < 2 {
+			return transient
+		}
+		go func() {
+			resp, err := http.Post(req.GetCallbackURL(), "application/json", strings.NewReader(`{"msg":"done"}`))
+			if err != nil {
+				t.Errorf("post callback failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return nil
+	}, func(data TestCallbackData) bool {
+		return data.Msg == "done"
+	}, new(Option).SetClient(client).SetRetry(&RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond * 10,
+	}))
+	if err != nil {
+		t.Fatalf("to stream failed: %v", err)
+	}
+	event := <-events
+	if event.Err != nil || !event.Final || event.Data.Msg != "done" {
+		t.Fatalf("want final done, get %+v", event)
+	}
+	if attempts != 2 {
+		t.Fatalf("want 2 attempts, get %d", attempts)
+	}
+}
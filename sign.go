@@ -0,0 +1,133 @@
+package tosync
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/huaiyann/tosync/internal/signature"
+	"github.com/pkg/errors"
+)
+
+// 回调地址中的参数，除Sign外都受签名保护
+type callbackClaims struct {
+	AsyncID  string
+	KeyID    string
+	Nonce    string
+	Expire   int64 // 过期时间，unix秒
+	Ack      string
+	Verifier string // 下游签名的校验方式
+	Sign     string
+}
+
+// 回调地址中签名用的参数名
+var claimParams = map[string]bool{
+	"async_id": true,
+	"kid":      true,
+	"nonce":    true,
+	"exp":      true,
+	"sign":     true,
+	"ack":      true,
+	"vfy":      true,
+}
+
+func (c *callbackClaims) fields() []string {
+	return []string{c.AsyncID, c.Nonce, strconv.FormatInt(c.Expire, 10), c.Ack, c.Verifier}
+}
+
+func (c *callbackClaims) encode(values url.Values) {
+	values.Set("async_id", c.AsyncID)
+	values.Set("kid", c.KeyID)
+	values.Set("nonce", c.Nonce)
+	values.Set("exp", strconv.FormatInt(c.Expire, 10))
+	values.Set("sign", c.Sign)
+	if c.Ack != "" {
+		values.Set("ack", c.Ack)
+	}
+	if c.Verifier != "" {
+		values.Set("vfy", c.Verifier)
+	}
+}
+
+func decodeClaims(values url.Values) *callbackClaims {
+	expire, _ := strconv.ParseInt(values.Get("exp"), 10, 64)
+	return &callbackClaims{
+		AsyncID:  values.Get("async_id"),
+		KeyID:    values.Get("kid"),
+		Nonce:    values.Get("nonce"),
+		Expire:   expire,
+		Ack:      values.Get("ack"),
+		Verifier: values.Get("vfy"),
+		Sign:     values.Get("sign"),
+	}
+}
+
+// 生成带签名的callbackURL
+func (c *Client) signedURL(asyncID string, opt *Option) (string, error) {
+	nonce, err := signature.NewNonce()
+	if err != nil {
+		return "", errors.Wrap(err, "new nonce")
+	}
+	claims := &callbackClaims{
+		AsyncID:  asyncID,
+		Nonce:    nonce,
+		Expire:   time.Now().Add(c.signTTL(opt)).Unix(),
+		Ack:      opt.Ack,
+		Verifier: opt.Verifier,
+	}
+	return c.encodeURL(claims)
+}
+
+// 签名并把参数拼接到callbackURL中，路径模式时填入模板
+func (c *Client) encodeURL(claims *callbackClaims) (string, error) {
+	claims.KeyID, claims.Sign = c.signer.Sign(claims.fields()...)
+	if c.pathTmpl != nil {
+		return c.pathTmpl.encode(c.callbackURL, claims)
+	}
+
+	newURL, err := url.Parse(c.callbackURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse callbackURL %s", c.callbackURL)
+	}
+	values := newURL.Query()
+	claims.encode(values)
+	newURL.RawQuery = values.Encode()
+	return newURL.String(), nil
+}
+
+// 解析callback请求中的参数，不做校验
+func (c *Client) parseClaims(r *http.Request) *callbackClaims {
+	if c.pathTmpl != nil {
+		return c.pathTmpl.decode(r.URL.Path)
+	}
+	return decodeClaims(r.URL.Query())
+}
+
+// 解析并校验callback请求中的参数
+func (c *Client) verifyClaims(r *http.Request) (*callbackClaims, error) {
+	claims := c.parseClaims(r)
+	if claims.AsyncID == "" || claims.Expire <= 0 || !c.signer.Check(claims.KeyID, claims.Sign, claims.fields()...) {
+		return nil, ErrInvalidSign
+	}
+	if time.Now().Unix() > claims.Expire {
+		return nil, errors.Wrapf(ErrSignExpired, "expired at %s", time.Unix(claims.Expire, 0).Format(time.RFC3339))
+	}
+	return claims, nil
+}
+
+// 回调地址的有效期：请求超时时间加上宽限期
+func (c *Client) signTTL(opt *Option) time.Duration {
+	return c.timeoutOf(opt) + c.signGrace
+}
+
+func newSigner(keys []SignKey) (*signature.Signer, error) {
+	tmp := make([]signature.Key, 0, len(keys))
+	for _, key := range keys {
+		tmp = append(tmp, signature.Key{
+			ID:     key.ID,
+			Secret: []byte(key.Secret),
+		})
+	}
+	return signature.NewSigner(tmp...)
+}
@@ -0,0 +1,78 @@
+package tosync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func newSignTestClient(t *testing.T) *Client {
+	signer, err := newSigner(testSignKeys)
+	if err != nil {
+		t.Fatalf("new signer failed: %v", err)
+	}
+	return &Client{
+		callbackURL: "http://localhost/callback?from=test",
+		signer:      signer,
+		signGrace:   time.Minute,
+		timeout:     time.Second * 10,
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	client := newSignTestClient(t)
+
+	// 正常
+	signedURL, err := client.signedURL("async_id", new(Option))
+	if err != nil {
+		t.Fatalf("sign url failed: %v", err)
+	}
+	claims, err := client.verifyClaims(httptest.NewRequest(http.MethodPost, signedURL, nil))
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if claims.AsyncID != "async_id" {
+		t.Fatalf("want async_id, get %s", claims.AsyncID)
+	}
+	// 有效期为超时加宽限期
+	if sub := time.Until(time.Unix(claims.Expire, 0)); sub < time.Second*69 || sub > time.Second*71 {
+		t.Fatalf("want expire in 70s, get %v", sub)
+	}
+
+	// 篡改async_id
+	req := httptest.NewRequest(http.MethodPost, signedURL, nil)
+	query := req.URL.Query()
+	query.Set("async_id", "other")
+	req.URL.RawQuery = query.Encode()
+	_, err = client.verifyClaims(req)
+	if !errors.Is(err, ErrInvalidSign) {
+		t.Fatalf("want %v, get %v", ErrInvalidSign, err)
+	}
+
+	// 篡改过期时间
+	req = httptest.NewRequest(http.MethodPost, signedURL, nil)
+	query = req.URL.Query()
+	query.Set("exp", "9999999999")
+	req.URL.RawQuery = query.Encode()
+	_, err = client.verifyClaims(req)
+	if !errors.Is(err, ErrInvalidSign) {
+		t.Fatalf("want %v, get %v", ErrInvalidSign, err)
+	}
+
+	// 已过期
+	expiredURL, err := client.encodeURL(&callbackClaims{
+		AsyncID: "async_id",
+		Nonce:   "nonce",
+		Expire:  time.Now().Add(-time.Second).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("sign url failed: %v", err)
+	}
+	_, err = client.verifyClaims(httptest.NewRequest(http.MethodPost, expiredURL, nil))
+	if !errors.Is(err, ErrSignExpired) {
+		t.Fatalf("want %v, get %v", ErrSignExpired, err)
+	}
+}
@@ -0,0 +1,127 @@
+package tosync
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrResultNotFound = errors.New("result not found")
+
+// DefaultResultTTL 回调结果默认的保存时间
+const DefaultResultTTL = time.Hour * 24
+
+// ResultStore 按async_id持久化回调，ToSync超时或等待方重启后仍可通过Await、Lookup取回结果。
+// 同一个async_id多次回调时保存最后一次
+type ResultStore interface {
+	// Save 保存一次回调，data为序列化后的CallbackInfo
+	Save(ctx context.Context, asyncID string, data []byte, ttl time.Duration) error
+	// Load 读取最后一次回调，没有时返回ErrResultNotFound
+	Load(ctx context.Context, asyncID string) ([]byte, error)
+}
+
+// RedisResultStore 基于SET EX的ResultStore，每个async_id一个独立的key
+type RedisResultStore struct {
+	cli    redis.UniversalClient
+	prefix string
+}
+
+func NewRedisResultStore(cli redis.UniversalClient, prefix string) *RedisResultStore {
+	return &RedisResultStore{
+		cli:    cli,
+		prefix: prefix,
+	}
+}
+
+func (s *RedisResultStore) Save(ctx context.Context, asyncID string, data []byte, ttl time.Duration) error {
+	err := s.cli.Set(ctx, s.prefix+asyncID, data, ttl).Err()
+	if err != nil {
+		return errors.Wrap(err, "redis set")
+	}
+	return nil
+}
+
+func (s *RedisResultStore) Load(ctx context.Context, asyncID string) ([]byte, error) {
+	data, err := s.cli.Get(ctx, s.prefix+asyncID).Bytes()
+	if err == redis.Nil {
+		return nil, ErrResultNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "redis get")
+	}
+	return data, nil
+}
+
+// MemoryResultStore 进程内的ResultStore，只适用于单实例部署
+type MemoryResultStore struct {
+	lock    sync.Mutex
+	results map[string]*storedResult
+}
+
+type storedResult struct {
+	data   []byte
+	expire time.Time
+}
+
+func NewMemoryResultStore() *MemoryResultStore {
+	return &MemoryResultStore{
+		results: make(map[string]*storedResult),
+	}
+}
+
+func (s *MemoryResultStore) Save(ctx context.Context, asyncID string, data []byte, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	s.results[asyncID] = &storedResult{
+		data:   append([]byte(nil), data...),
+		expire: now.Add(ttl),
+	}
+	return nil
+}
+
+// 顺带清理过期的记录，每次最多检查sweepBatch条
+func (s *MemoryResultStore) sweep(now time.Time) {
+	checked := 0
+	for id, result := range s.results {
+		if checked >= sweepBatch {
+			return
+		}
+		checked++
+		if now.After(result.expire) {
+			delete(s.results, id)
+		}
+	}
+}
+
+func (s *MemoryResultStore) Load(ctx context.Context, asyncID string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result, ok := s.results[asyncID]
+	if !ok || time.Now().After(result.expire) {
+		return nil, ErrResultNotFound
+	}
+	return result.data, nil
+}
+
+// 读取保存的回调，未配置ResultStore时返回ErrResultNotFound
+func (c *Client) loadResult(ctx context.Context, asyncID string) (*CallbackInfoParsed, error) {
+	if c.resultStore == nil {
+		return nil, errors.Wrap(ErrResultNotFound, "result store not set")
+	}
+	buf, err := c.resultStore.Load(ctx, asyncID)
+	if err != nil {
+		return nil, err
+	}
+	callbackInfo := new(CallbackInfo)
+	err = json.Unmarshal(buf, callbackInfo)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal callbackInfo")
+	}
+	return callbackInfo.parse("")
+}
@@ -0,0 +1,151 @@
+package tosync
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestMemoryResultStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryResultStore()
+	_, err := s.Load(ctx, "a")
+	if !errors.Is(err, ErrResultNotFound) {
+		t.Fatalf("want %v, get %v", ErrResultNotFound, err)
+	}
+	err = s.Save(ctx, "a", []byte("1"), time.Minute)
+	if err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	// 保存最后一次
+	err = s.Save(ctx, "a", []byte("2"), time.Millisecond)
+	if err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	data, err := s.Load(ctx, "a")
+	if err != nil || string(data) != "2" {
+		t.Fatalf("want 2, get %s %v", data, err)
+	}
+	// 过期
+	time.Sleep(time.Millisecond * 5)
+	_, err = s.Load(ctx, "a")
+	if !errors.Is(err, ErrResultNotFound) {
+		t.Fatalf("want %v, get %v", ErrResultNotFound, err)
+	}
+}
+
+func TestMemoryResultStoreSweep(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryResultStore()
+	for i := 0; i < sweepBatch*4; i++ {
+		s.Save(ctx, strconv.Itoa(i), []byte("1"), time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 5)
+	for i := 0; i < 100 && len(s.results) > 1; i++ {
+		s.Save(ctx, "a", []byte("1"), time.Minute)
+	}
+	if n := len(s.results); n != 1 {
+		t.Fatalf("want 1 left, get %d", n)
+	}
+}
+
+func TestAwaitLookup(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10, new(ClientOption).SetResultStore(NewMemoryResultStore(), 0))
+	opt := new(Option).SetClient(client)
+
+	post := func(callbackURL, msg string) {
+		resp, err := http.Post(callbackURL, "application/json", strings.NewReader(`{"msg":"`+msg+`"}`))
+		if err != nil {
+			t.Errorf("post callback failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	// ToSync超时后才回调，结果仍可取回
+	var callbackURL string
+	_, err := ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		callbackURL = req.GetCallbackURL()
+		return nil
+	}, opt, new(Option).SetAsyncID("order-1").SetTimeout(time.Millisecond*50))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
+	}
+	_, err = Lookup[TestCallbackData](ctx, "order-1", opt)
+	if !errors.Is(err, ErrResultNotFound) {
+		t.Fatalf("want %v, get %v", ErrResultNotFound, err)
+	}
+	post(callbackURL, "late")
+
+	env, err := Lookup[TestCallbackData](ctx, "order-1", opt)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if env.Data.Msg != "late" || env.AsyncID != "order-1" {
+		t.Fatalf("want late of order-1, get %+v", env)
+	}
+	env, err = Await[TestCallbackData](ctx, "order-1", opt)
+	if err != nil {
+		t.Fatalf("await failed: %v", err)
+	}
+	if env.Data.Msg != "late" {
+		t.Fatalf("want late, get %s", env.Data.Msg)
+	}
+
+	// 结果还没有时继续等待回调
+	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		callbackURL = req.GetCallbackURL()
+		return nil
+	}, opt, new(Option).SetAsyncID("order-2").SetTimeout(time.Millisecond*50))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		post(callbackURL, "resumed")
+	}()
+	env, err = Await[TestCallbackData](ctx, "order-2", opt)
+	if err != nil {
+		t.Fatalf("await failed: %v", err)
+	}
+	if env.Data.Msg != "resumed" {
+		t.Fatalf("want resumed, get %s", env.Data.Msg)
+	}
+
+	// 同一个async_id同时只能有一个等待方
+	waitInfo, err := client.registURL(ctx, new(Option).SetAsyncID("order-3"), 1)
+	if err != nil {
+		t.Fatalf("regist failed: %v", err)
+	}
+	defer client.Release(waitInfo)
+	_, err = Await[TestCallbackData](ctx, "order-3", opt)
+	if err == nil || !strings.Contains(err.Error(), "already waiting") {
+		t.Fatalf("want already waiting error, get %v", err)
+	}
+
+	// 已有保存结果的async_id不能复用
+	_, err = client.registURL(ctx, new(Option).SetAsyncID("order-1"), 1)
+	if err == nil || !strings.Contains(err.Error(), "already has a stored result") {
+		t.Fatalf("want stored result error, get %v", err)
+	}
+	// 路径不安全的async_id
+	for _, asyncID := range []string{"order/1", "order%2F1", "order 1", "task:1"} {
+		_, err = client.registURL(ctx, new(Option).SetAsyncID(asyncID), 1)
+		if err == nil {
+			t.Fatalf("want error for async id %s", asyncID)
+		}
+	}
+
+	// 未配置ResultStore
+	other, _ := newTestClient(t, 1024*1024, 10)
+	_, err = Lookup[TestCallbackData](ctx, "order-1", new(Option).SetClient(other))
+	if !errors.Is(err, ErrResultNotFound) {
+		t.Fatalf("want %v, get %v", ErrResultNotFound, err)
+	}
+}
@@ -0,0 +1,262 @@
+package tosync
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zeromicro/go-zero/core/logc"
+)
+
+var ErrTicketClosed = errors.New("ticket closed")
+
+// 检查过期ticket的间隔
+const ticketSweepInterval = time.Second
+
+// 释放过期ticket时每次持有lock删除的数量
+const releaseBatch = 128
+
+// 注册waiter并提交异步任务，bufSize为waiter结果channel的容量
+type startFunc func(ctx context.Context, client *Client, opt *Option, bufSize int) (*WaiterInfo, error)
+
+// Ticket 已提交、等待回调的任务，用Wait取回结果。
+// 批量提交时不需要为每个任务阻塞一个goroutine
+type Ticket struct {
+	client   *Client
+	opt      *Option
+	waitInfo *WaiterInfo
+	deadline time.Time // 提交时间加超时时间
+
+	closeOnce sync.Once
+	closeC    chan struct{}
+}
+
+// Submit 注册waiter并提交异步任务，不等待回调。
+// 超时从提交开始计算，之后用Wait取回结果，不再需要时调用Cancel
+func Submit[Req ReqI](ctx context.Context, req Req, async func(context.Context, Req) error, opts ...*Option) (*Ticket, error) {
+	return submitTicket(ctx, mergeOptions(opts...), func(ctx context.Context, client *Client, opt *Option, bufSize int) (*WaiterInfo, error) {
+		return registAndSubmit(ctx, client, opt, func() (*WaiterInfo, error) {
+			return client.regist(ctx, req, opt, bufSize)
+		}, func(ctx context.Context, waitInfo *WaiterInfo) error {
+			return submit(ctx, req, async, waitInfo)
+		})
+	})
+}
+
+// Wait 等待ticket的终态回调，同ToSync。
+// 在ctx结束时返回ctx.Err()，ticket仍然有效，可以再次Wait；
+// 其他情况（收到终态回调、回调报告失败、超时、client关闭）返回后ticket关闭
+func Wait[CallbackData any](ctx context.Context, ticket *Ticket) (data CallbackData, err error) {
+	env, err := WaitRaw[CallbackData](ctx, ticket)
+	if env != nil {
+		data = env.Data
+	}
+	return
+}
+
+// WaitRaw 同Wait，额外返回回调请求的元信息
+func WaitRaw[CallbackData any](ctx context.Context, ticket *Ticket) (env *Envelope[CallbackData], err error) {
+	err = checkType[CallbackData]()
+	if err != nil {
+		err = errors.Wrap(err, "check CallbackData type")
+		return
+	}
+	return waitTicket[CallbackData](ctx, ticket)
+}
+
+// AsyncID 任务的async_id，可用于Await、Lookup
+func (t *Ticket) AsyncID() string {
+	return t.waitInfo.AsyncID
+}
+
+// Deadline 等待回调的截止时间
+func (t *Ticket) Deadline() time.Time {
+	return t.deadline
+}
+
+// Cancel 放弃等待，释放waiter，之后的Wait返回ErrTicketClosed。可重复调用
+func (t *Ticket) Cancel() {
+	t.closeOnce.Do(func() {
+		close(t.closeC)
+		t.client.Release(t.waitInfo)
+	})
+}
+
+func submitTicket(ctx context.Context, opt *Option, start startFunc) (*Ticket, error) {
+	client, err := pickClient(opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.done != nil {
+		if err = client.checkMultiCallback(); err != nil {
+			return nil, errors.Wrap(err, "DoneWhen")
+		}
+	}
+	deadline := time.Now().Add(client.timeoutOf(opt))
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	// 需要判断终态时，可能收到多次回调
+	bufSize := 1
+	if opt.done != nil {
+		bufSize = streamBufferSize
+	}
+	waitInfo, err := start(ctx, client, opt, bufSize)
+	if err != nil {
+		return nil, err
+	}
+	client.expireAt(waitInfo, deadline)
+	return &Ticket{
+		client:   client,
+		opt:      opt,
+		waitInfo: waitInfo,
+		deadline: deadline,
+		closeC:   make(chan struct{}),
+	}, nil
+}
+
+// 等待监听到的异步回调结果，非终态的回调忽略
+func waitTicket[CallbackData any](ctx context.Context, ticket *Ticket) (env *Envelope[CallbackData], err error) {
+	client, opt, waitInfo := ticket.client, ticket.opt, ticket.waitInfo
+	done, err := doneFunc[CallbackData](opt)
+	if err != nil {
+		return
+	}
+	resultErr, err := resultErrFunc[CallbackData](opt)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, ticket.deadline)
+	defer cancel()
+	for {
+		select {
+		case <-ticket.closeC:
+			err = ErrTicketClosed
+			return
+		default:
+		}
+		// 已到达的回调优先于超时，如提交超时但回调先到了
+		var callbackInfo *CallbackInfoParsed
+		select {
+		case callbackInfo = <-waitInfo.ResultC:
+		default:
+		}
+		if callbackInfo == nil {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				// 调用方提前结束时ticket仍然有效
+				if !time.Now().Before(ticket.deadline) {
+					ticket.Cancel()
+				}
+				return
+			case <-ticket.closeC:
+				err = ErrTicketClosed
+				return
+			case <-client.closeC:
+				err = ErrClientClosed
+				ticket.Cancel()
+				return
+			case callbackInfo = <-waitInfo.ResultC:
+			}
+		}
+		env, err = decodeCallback[CallbackData](ctx, client, opt, waitInfo.AsyncID, callbackInfo)
+		if err != nil {
+			env = nil
+			ticket.Cancel()
+			return
+		}
+		finished := true
+		if done != nil {
+			finished, err = done(env.Data)
+			if err != nil {
+				err = errors.Wrap(err, "check callback done")
+				ticket.Cancel()
+				return
+			}
+		}
+		if finished {
+			err = checkResult(waitInfo.AsyncID, env.Data, resultErr)
+			ticket.Cancel()
+			return
+		}
+		logc.Infof(ctx, "[ToSync] async id %s get non-final callback, keep waiting", waitInfo.AsyncID)
+	}
+}
+
+// waiter的截止时间
+type waiterExpiry struct {
+	deadline time.Time
+	info     *WaiterInfo
+}
+
+// 按截止时间排序的小顶堆
+type expiryHeap []waiterExpiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x any) {
+	*h = append(*h, x.(waiterExpiry))
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = waiterExpiry{}
+	*h = old[:n-1]
+	return x
+}
+
+// 记录ticket的截止时间。正常结束的ticket不从堆中移除，到期时随过期的一起弹出
+func (c *Client) expireAt(info *WaiterInfo, deadline time.Time) {
+	c.expiryLock.Lock()
+	defer c.expiryLock.Unlock()
+	heap.Push(&c.expiries, waiterExpiry{deadline: deadline, info: info})
+}
+
+// 释放超过截止时间仍未取回的ticket，调用方既不Wait也不Cancel时waiter不会一直留在内存中。
+// 每个client一个，client关闭时退出
+func (c *Client) sweepTickets() {
+	ticker := time.NewTicker(ticketSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closeC:
+			return
+		case now := <-ticker.C:
+			c.releaseExpired(now)
+		}
+	}
+}
+
+// 只从堆中取出已过期的，分批持有lock删除，不阻塞回调投递和注册
+func (c *Client) releaseExpired(now time.Time) {
+	var expired []*WaiterInfo
+	c.expiryLock.Lock()
+	for len(c.expiries) > 0 && now.After(c.expiries[0].deadline) {
+		expired = append(expired, heap.Pop(&c.expiries).(waiterExpiry).info)
+	}
+	c.expiryLock.Unlock()
+
+	for len(expired) > 0 {
+		n := releaseBatch
+		if n > len(expired) {
+			n = len(expired)
+		}
+		c.lock.Lock()
+		for _, info := range expired[:n] {
+			// 已经释放、或同一个async_id注册了新的waiter
+			if c.waiters[info.AsyncID] == info {
+				delete(c.waiters, info.AsyncID)
+			}
+		}
+		c.lock.Unlock()
+		expired = expired[n:]
+	}
+}
@@ -0,0 +1,183 @@
+package tosync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestSubmitWait(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client)
+
+	post := func(callbackURL, msg string) {
+		resp, err := http.Post(callbackURL, "application/json", strings.NewReader(`{"msg":"`+msg+`"}`))
+		if err != nil {
+			t.Errorf("post callback failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	// 一个goroutine批量提交，之后统一取回
+	reqs := make([]*TestReq, 20)
+	tickets := make([]*Ticket, 0, len(reqs))
+	for i := range reqs {
+		reqs[i] = &TestReq{}
+		ticket, err := Submit(ctx, reqs[i], func(ctx context.Context, req *TestReq) error {
+			return nil
+		}, opt)
+		if err != nil {
+			t.Fatalf("submit failed: %v", err)
+		}
+		tickets = append(tickets, ticket)
+	}
+	for i := len(reqs) - 1; i >= 0; i-- {
+		post(reqs[i].GetCallbackURL(), fmt.Sprint(i))
+	}
+	for i, ticket := range tickets {
+		data, err := Wait[TestCallbackData](ctx, ticket)
+		if err != nil {
+			t.Fatalf("wait %s failed: %v", ticket.AsyncID(), err)
+		}
+		if data.Msg != fmt.Sprint(i) {
+			t.Fatalf("want %d, get %s", i, data.Msg)
+		}
+		// 取回后ticket关闭
+		_, err = Wait[TestCallbackData](ctx, ticket)
+		if !errors.Is(err, ErrTicketClosed) {
+			t.Fatalf("want %v, get %v", ErrTicketClosed, err)
+		}
+	}
+
+	// 调用方的ctx结束时ticket仍然有效
+	req := &TestReq{}
+	ticket, err := Submit(ctx, req, func(ctx context.Context, req *TestReq) error {
+		return nil
+	}, opt)
+	if err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, time.Millisecond*20)
+	_, err = Wait[TestCallbackData](shortCtx, ticket)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
+	}
+	post(req.GetCallbackURL(), "ok")
+	data, err := Wait[TestCallbackData](ctx, ticket)
+	if err != nil || data.Msg != "ok" {
+		t.Fatalf("want ok, get %s %v", data.Msg, err)
+	}
+
+	// 取消
+	ticket, err = Submit(ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		return nil
+	}, opt)
+	if err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	ticket.Cancel()
+	ticket.Cancel()
+	_, err = Wait[TestCallbackData](ctx, ticket)
+	if !errors.Is(err, ErrTicketClosed) {
+		t.Fatalf("want %v, get %v", ErrTicketClosed, err)
+	}
+
+	// 超时从提交开始计算
+	ticket, err = Submit(ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		return nil
+	}, opt, new(Option).SetTimeout(time.Millisecond*50))
+	if err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	time.Sleep(time.Millisecond * 60)
+	_, err = Wait[TestCallbackData](ctx, ticket)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
+	}
+	_, err = Wait[TestCallbackData](ctx, ticket)
+	if !errors.Is(err, ErrTicketClosed) {
+		t.Fatalf("want %v, get %v", ErrTicketClosed, err)
+	}
+
+	// 提交失败时不返回ticket，waiter已释放
+	submitErr := errors.New("submit failed")
+	_, err = Submit(ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		return submitErr
+	}, opt)
+	if !errors.Is(err, submitErr) {
+		t.Fatalf("want %v, get %v", submitErr, err)
+	}
+	client.lock.RLock()
+	waiters := len(client.waiters)
+	client.lock.RUnlock()
+	if waiters != 0 {
+		t.Fatalf("want waiters released, get %d", waiters)
+	}
+}
+
+func TestTicketSweep(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+
+	// 既不Wait也不Cancel的ticket，过期后由sweeper释放
+	_, err := Submit(ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		return nil
+	}, new(Option).SetClient(client).SetTimeout(time.Millisecond*50))
+	if err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	waiters := func() int {
+		client.lock.RLock()
+		defer client.lock.RUnlock()
+		return len(client.waiters)
+	}
+	if n := waiters(); n != 1 {
+		t.Fatalf("want 1 waiter, get %d", n)
+	}
+	for start := time.Now(); time.Since(start) < ticketSweepInterval*3 && waiters() > 0; time.Sleep(time.Millisecond * 10) {
+	}
+	if n := waiters(); n != 0 {
+		t.Fatalf("want waiters released, get %d", n)
+	}
+	client.expiryLock.Lock()
+	expiries := len(client.expiries)
+	client.expiryLock.Unlock()
+	if expiries != 0 {
+		t.Fatalf("want expiries popped, get %d", expiries)
+	}
+}
+
+func TestReleaseExpired(t *testing.T) {
+	client := &Client{waiters: make(map[string]*WaiterInfo)}
+	now := time.Now()
+	for i := 0; i < releaseBatch*2+1; i++ {
+		info := &WaiterInfo{AsyncID: fmt.Sprint(i)}
+		client.waiters[info.AsyncID] = info
+		client.expireAt(info, now.Add(time.Duration(i%3-1)*time.Minute))
+	}
+	// 同一个async_id重新注册的waiter不受旧的截止时间影响
+	client.waiters["0"] = &WaiterInfo{AsyncID: "0"}
+
+	client.releaseExpired(now)
+	for id := range client.waiters {
+		var i int
+		fmt.Sscan(id, &i)
+		if i%3 == 0 && id != "0" {
+			t.Fatalf("want %s released", id)
+		}
+	}
+	if _, ok := client.waiters["0"]; !ok {
+		t.Fatal("want new waiter of 0 kept")
+	}
+	if n := len(client.expiries); n != (releaseBatch*2+1)*2/3 {
+		t.Fatalf("want unexpired kept in heap, get %d", n)
+	}
+}
@@ -4,118 +4,402 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
-	"time"
+	"sync"
 
-	"github.com/huaiyann/tosync/internal/messager"
 	"github.com/pkg/errors"
 	"github.com/redis/go-redis/v9"
 	"github.com/zeromicro/go-zero/core/logc"
 )
 
-var defaultClient *Client
+var (
+	defaultLock   sync.Mutex
+	defaultClient *Client
+)
 
 type ReqI interface {
 	SetCallbackURL(url string)
 	GetCallbackURL() string
 }
 
-func Init(redisCli *redis.Client, cfg *Config) (err error) {
+func Init(redisCli redis.UniversalClient, cfg *Config, opts ...*ClientOption) (err error) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
 	if defaultClient != nil {
 		err = errors.New("client already inited")
 		return
 	}
-	if err := cfg.Validate(); err != nil {
-		err = errors.Wrap(err, "validate config")
-		return err
+	client, err := NewClient(redisCli, cfg, opts...)
+	if err != nil {
+		return
 	}
+	defaultClient = client
+	return
+}
 
-	msger, err := messager.NewRedisMessager(redisCli, cfg.Stream)
-	if err != nil {
-		err = errors.Wrap(err, "new redis messager")
+// Shutdown 关闭Init创建的默认client，之后可以重新Init
+func Shutdown(ctx context.Context) (err error) {
+	defaultLock.Lock()
+	client := defaultClient
+	defaultClient = nil
+	defaultLock.Unlock()
+	if client == nil {
 		return
 	}
-	defaultClient = &Client{
-		messager:    msger,
-		waiters:     make(map[string]*WaiterInfo),
-		callbackURL: cfg.CallbackURL,
-		maxSize:     cfg.MaxCallbackBytes,
-		timeout:     time.Second * time.Duration(cfg.TimeoutSeconds),
+	return client.Close(ctx)
+}
+
+func getDefaultClient() *Client {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	return defaultClient
+}
+
+func ToSync[Req ReqI, CallbackData any](ctx context.Context, req Req, async func(context.Context, Req) error, opts ...*Option) (data CallbackData, err error) {
+	env, err := ToSyncRaw[Req, CallbackData](ctx, req, async, opts...)
+	if env != nil {
+		data = env.Data
 	}
-	go defaultClient.listen()
 	return
 }
 
-func ToSync[Req ReqI, CallbackData any](ctx context.Context, req Req, async func(context.Context, Req) error, opts ...*Option) (data CallbackData, err error) {
+// ToSyncRaw 同ToSync，但额外返回回调请求的元信息（header、query、content-type等）。
+// 回调中报告失败时，env和*CallbackError同时返回
+func ToSyncRaw[Req ReqI, CallbackData any](ctx context.Context, req Req, async func(context.Context, Req) error, opts ...*Option) (env *Envelope[CallbackData], err error) {
+	return toSyncRaw[CallbackData](ctx, mergeOptions(opts...), func(ctx context.Context, client *Client, opt *Option, bufSize int) (*WaiterInfo, error) {
+		return registAndSubmit(ctx, client, opt, func() (*WaiterInfo, error) {
+			return client.regist(ctx, req, opt, bufSize)
+		}, func(ctx context.Context, waitInfo *WaiterInfo) error {
+			return submit(ctx, req, async, waitInfo)
+		})
+	})
+}
+
+// ToSyncFunc 同ToSync，但不要求请求实现ReqI：生成的callbackURL交给async，
+// 由async放到请求中的任意位置（嵌套字段、header等），结构体可以用InjectCallbackURL按tag填入
+func ToSyncFunc[CallbackData any](ctx context.Context, async func(ctx context.Context, callbackURL string) error, opts ...*Option) (data CallbackData, err error) {
+	env, err := ToSyncFuncRaw[CallbackData](ctx, async, opts...)
+	if env != nil {
+		data = env.Data
+	}
+	return
+}
+
+// ToSyncFuncRaw 同ToSyncFunc，额外返回回调请求的元信息
+func ToSyncFuncRaw[CallbackData any](ctx context.Context, async func(ctx context.Context, callbackURL string) error, opts ...*Option) (env *Envelope[CallbackData], err error) {
+	return toSyncRaw[CallbackData](ctx, mergeOptions(opts...), func(ctx context.Context, client *Client, opt *Option, bufSize int) (*WaiterInfo, error) {
+		return registAndSubmit(ctx, client, opt, func() (*WaiterInfo, error) {
+			return client.registURL(ctx, opt, bufSize)
+		}, func(ctx context.Context, waitInfo *WaiterInfo) error {
+			return submitFunc(ctx, async, waitInfo)
+		})
+	})
+}
+
+// ToSyncTask 用于只回调固定地址、用自己的任务id标识任务的下游：async提交任务并返回下游的任务id，
+// 回调由ClientOption.SetTaskIDExtractor取出任务id后关联到这里。
+// 回调先于async返回到达时会暂存一段时间，注册后立即交付。
+// 没有签名的回调地址，Option中的Ack、Verifier不生效，使用client默认的
+func ToSyncTask[CallbackData any](ctx context.Context, async func(ctx context.Context) (taskID string, err error), opts ...*Option) (data CallbackData, err error) {
+	env, err := ToSyncTaskRaw[CallbackData](ctx, async, opts...)
+	if env != nil {
+		data = env.Data
+	}
+	return
+}
+
+// ToSyncTaskRaw 同ToSyncTask，额外返回回调请求的元信息
+func ToSyncTaskRaw[CallbackData any](ctx context.Context, async func(ctx context.Context) (taskID string, err error), opts ...*Option) (env *Envelope[CallbackData], err error) {
+	return toSyncRaw[CallbackData](ctx, mergeOptions(opts...), func(ctx context.Context, client *Client, opt *Option, bufSize int) (*WaiterInfo, error) {
+		if client.taskIDExtractor == nil {
+			return nil, errors.New("task id extractor not set")
+		}
+		taskID, err := async(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "exec async func")
+		}
+		waitInfo, err := client.registTask(taskID, bufSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "regist task")
+		}
+		logc.Infof(ctx, "[ToSync] task submitted, task id %s", taskID)
+		return waitInfo, nil
+	})
+}
+
+// Lookup 从ResultStore读取asyncID的最后一次回调，没有时返回ErrResultNotFound。
+// 不等待，也不判断DoneWhen；回调报告失败时env和*CallbackError同时返回
+func Lookup[CallbackData any](ctx context.Context, asyncID string, opts ...*Option) (env *Envelope[CallbackData], err error) {
 	opt := mergeOptions(opts...)
+	client, err := pickClient(opt)
+	if err != nil {
+		return
+	}
+	err = checkType[CallbackData]()
+	if err != nil {
+		err = errors.Wrap(err, "check CallbackData type")
+		return
+	}
+	resultErr, err := resultErrFunc[CallbackData](opt)
+	if err != nil {
+		return
+	}
+	callbackInfo, err := client.loadResult(ctx, asyncID)
+	if err != nil {
+		return
+	}
+	env, err = decodeCallback[CallbackData](ctx, client, opt, asyncID, callbackInfo)
+	if err != nil {
+		env = nil
+		return
+	}
+	err = checkResult(asyncID, env.Data, resultErr)
+	return
+}
 
-	var client *Client
-	if opt.Client != nil {
-		client = opt.Client
-	} else {
-		client = defaultClient
+// Await 继续等待之前提交的asyncID（ToSync超时后，或等待方重启后），
+// ResultStore中已有结果时直接返回，否则等待之后的回调，受超时控制
+func Await[CallbackData any](ctx context.Context, asyncID string, opts ...*Option) (env *Envelope[CallbackData], err error) {
+	return toSyncRaw[CallbackData](ctx, mergeOptions(opts...), func(ctx context.Context, client *Client, opt *Option, bufSize int) (*WaiterInfo, error) {
+		if asyncID == "" {
+			return nil, errors.New("async id is empty")
+		}
+		waitInfo := &WaiterInfo{
+			AsyncID: asyncID,
+			ResultC: make(chan *CallbackInfoParsed, bufSize),
+		}
+		err := client.addWaiter(waitInfo)
+		if err != nil {
+			return nil, errors.Wrap(err, "regist waiter")
+		}
+		// 先注册再读取，避免错过两者之间到达的回调
+		callbackInfo, err := client.loadResult(ctx, asyncID)
+		if err == nil {
+			select {
+			case waitInfo.ResultC <- callbackInfo:
+			default:
+				// 期间已收到新的回调
+			}
+		} else if !errors.Is(err, ErrResultNotFound) {
+			client.Release(waitInfo)
+			return nil, errors.Wrap(err, "load result")
+		}
+		return waitInfo, nil
+	})
+}
+
+// 提交任务并等待终态回调，start负责注册waiter和提交，bufSize为waiter结果channel的容量
+func toSyncRaw[CallbackData any](ctx context.Context, opt *Option, start startFunc) (env *Envelope[CallbackData], err error) {
+	// 类型不对时不提交
+	err = checkType[CallbackData]()
+	if err != nil {
+		err = errors.Wrap(err, "check CallbackData type")
+		return
 	}
-	if client == nil {
-		err = errors.New("client not inited")
+	_, err = doneFunc[CallbackData](opt)
+	if err != nil {
+		return
+	}
+	_, err = resultErrFunc[CallbackData](opt)
+	if err != nil {
 		return
 	}
 
-	timeout := client.timeout
-	if opt.Timeout > 0 {
-		timeout = opt.Timeout
+	ticket, err := submitTicket(ctx, opt, start)
+	if err != nil {
+		return
 	}
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+	defer ticket.Cancel()
+	return waitTicket[CallbackData](ctx, ticket)
+}
+
+// Event 流式回调中的一次事件
+type Event[CallbackData any] struct {
+	Data  CallbackData
+	Final bool  // 终态回调，之后channel关闭
+	Err   error // 解析失败、回调报告失败（*CallbackError）、超时或client关闭，之后channel关闭
+}
 
+// ToStream 用于一个任务会多次回调的下游（如 已接收 -> 处理中40% -> 完成），
+// 每次回调都作为一个Event发出，isFinal判断为终态或出错后channel关闭。
+// 整个过程受超时控制，提前放弃时cancel ctx即可。client开启DedupFirstWins去重时不能使用
+func ToStream[Req ReqI, CallbackData any](ctx context.Context, req Req, async func(context.Context, Req) error, isFinal func(CallbackData) bool, opts ...*Option) (events <-chan Event[CallbackData], err error) {
+	opt := mergeOptions(opts...)
+	client, err := pickClient(opt)
+	if err != nil {
+		return
+	}
+	if isFinal == nil {
+		err = errors.New("isFinal is nil")
+		return
+	}
+	err = client.checkMultiCallback()
+	if err != nil {
+		err = errors.Wrap(err, "ToStream")
+		return
+	}
+
+	resultErr, err := resultErrFunc[CallbackData](opt)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, client.timeoutOf(opt))
 	err = checkType[CallbackData]()
 	if err != nil {
+		cancel()
 		err = errors.Wrap(err, "check CallbackData type")
 		return
 	}
 
-	// 注册监听结果任务，包括会调整req内的callbackURL
-	waitInfo, err := client.Regist(req)
+	// 与ToSync一样按Option重试、接受提前到达的回调
+	waitInfo, err := registAndSubmit(ctx, client, opt, func() (*WaiterInfo, error) {
+		return client.regist(ctx, req, opt, streamBufferSize)
+	}, func(ctx context.Context, waitInfo *WaiterInfo) error {
+		return submit(ctx, req, async, waitInfo)
+	})
 	if err != nil {
-		err = errors.Wrap(err, "regist req")
+		cancel()
 		return
 	}
-	defer client.Release(waitInfo)
 
-	// 提交异步任务
-	err = async(ctx, req)
+	out := make(chan Event[CallbackData], streamBufferSize)
+	go func() {
+		defer close(out)
+		defer cancel()
+		defer client.Release(waitInfo)
+		for {
+			var event Event[CallbackData]
+			select {
+			case <-ctx.Done():
+				event.Err = ctx.Err()
+			case <-client.closeC:
+				event.Err = ErrClientClosed
+			case callbackInfo := <-waitInfo.ResultC:
+				var env *Envelope[CallbackData]
+				env, event.Err = decodeCallback[CallbackData](ctx, client, opt, waitInfo.AsyncID, callbackInfo)
+				if event.Err == nil {
+					event.Data = env.Data
+					event.Err = checkResult(waitInfo.AsyncID, event.Data, resultErr)
+				}
+				event.Final = event.Err == nil && isFinal(event.Data)
+			}
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				// 消费方没有及时读取时，尽量把结束原因发出去
+				select {
+				case out <- Event[CallbackData]{Err: ctx.Err()}:
+				default:
+				}
+				return
+			}
+			if event.Final || event.Err != nil {
+				return
+			}
+		}
+	}()
+	events = out
+	return
+}
+
+// 取出DoneWhen设置的终态判断函数，类型需要和CallbackData一致
+func doneFunc[CallbackData any](opt *Option) (func(CallbackData) (bool, error), error) {
+	if opt.done == nil {
+		return nil, nil
+	}
+	done, ok := opt.done.(func(CallbackData) (bool, error))
+	if !ok {
+		var null CallbackData
+		return nil, errors.Errorf("DoneWhen func %T not match CallbackData %T", opt.done, null)
+	}
+	return done, nil
+}
+
+// 按Option选择client，未指定时使用默认client
+func pickClient(opt *Option) (*Client, error) {
+	if opt.Client != nil {
+		return opt.Client, nil
+	}
+	client := getDefaultClient()
+	if client == nil {
+		return nil, errors.New("client not inited")
+	}
+	return client, nil
+}
+
+// 注册监听结果任务（包括会调整req内的callbackURL）后提交异步任务，提交失败时释放。
+// 提交可能在回调到达之后才返回错误（如提交接口重试、客户端超时），
+// 开启Option.SetEarlyAccept时以已到达的回调为准
+func registAndSubmit(ctx context.Context, client *Client, opt *Option, regist func() (*WaiterInfo, error), run func(context.Context, *WaiterInfo) error) (*WaiterInfo, error) {
+	waitInfo, err := regist()
 	if err != nil {
-		err = errors.Wrap(err, "exec async func")
-		return
+		return nil, errors.Wrap(err, "regist req")
+	}
+	err = runWithRetry(ctx, client, opt, waitInfo, run)
+	if err == nil {
+		return waitInfo, nil
+	}
+	if opt.EarlyAccept && client.waitCallback(waitInfo, earlyAcceptWait) {
+		logc.Infof(ctx, "[ToSync] async id %s submit failed but callback arrived, use the callback: %v", waitInfo.AsyncID, err)
+		return waitInfo, nil
 	}
+	client.Release(waitInfo)
+	return nil, err
+}
 
+// 提交异步任务
+func submit[Req ReqI](ctx context.Context, req Req, async func(context.Context, Req) error, waitInfo *WaiterInfo) error {
+	err := async(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "exec async func")
+	}
 	buf, _ := json.Marshal(req)
 	logc.Infof(ctx, "[ToSync] task submitted, async id %s, param %s", waitInfo.AsyncID, buf)
+	return nil
+}
 
-	// 等待监听到的异步回调结果
-	select {
-	case <-ctx.Done():
-		err = ctx.Err()
-		if err != nil {
-			return
-		}
-	case callbackInfo := <-waitInfo.ResultC:
-		tmp := newParam[CallbackData]()
+// 把callbackURL交给async提交异步任务
+func submitFunc(ctx context.Context, async func(context.Context, string) error, waitInfo *WaiterInfo) error {
+	err := async(ctx, waitInfo.CallbackURL)
+	if err != nil {
+		return errors.Wrap(err, "exec async func")
+	}
+	logc.Infof(ctx, "[ToSync] task submitted, async id %s", waitInfo.AsyncID)
+	return nil
+}
+
+// 确认并解析一次回调
+func decodeCallback[CallbackData any](ctx context.Context, client *Client, opt *Option, asyncID string, callbackInfo *CallbackInfoParsed) (env *Envelope[CallbackData], err error) {
+	tmp := newParam[CallbackData]()
+	// 从ResultStore读取的回调没有消息id
+	if callbackInfo.MsgID != "" {
 		err = client.messager.Ack(ctx, callbackInfo.MsgID)
 		if err != nil {
 			err = errors.Wrap(err, "ack")
 			return
 		}
-		err = json.Unmarshal(callbackInfo.Body, tmp.Interface())
-		if err != nil {
-			err = errors.Wrap(err, "unmarshal callback body")
-			return
-		}
-		data = tmp.Elem().Interface().(CallbackData)
+	}
+	decoder := client.decoderFor(opt, callbackInfo.ContentType, tmp.Type().Elem())
+	err = decoder.Decode(callbackInfo.Body, tmp.Interface())
+	if err != nil {
+		err = errors.Wrap(err, "unmarshal callback body")
+		return
+	}
+	env = &Envelope[CallbackData]{
+		AsyncID:     asyncID,
+		Data:        tmp.Elem().Interface().(CallbackData),
+		Body:        callbackInfo.Body,
+		ContentType: callbackInfo.ContentType,
+		Method:      callbackInfo.Method,
+		Header:      callbackInfo.Header,
+		Query:       callbackInfo.Query,
+		RemoteAddr:  callbackInfo.RemoteAddr,
 	}
 	return
 }
 
 func CallbackHandler(ctx context.Context, r *http.Request) (err error) {
-	client := defaultClient
+	client := getDefaultClient()
 	if client == nil {
 		err = errors.New("client not inited")
 		return
@@ -4,55 +4,279 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/huaiyann/tosync/internal/messager"
 	"github.com/huaiyann/tosync/internal/signature"
 	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
 	"github.com/zeromicro/go-zero/core/logc"
 )
 
-var ErrInvalidSign = errors.New("invalid sign")
+// DefaultSignGrace 未配置SignGraceSeconds时，回调地址在超时之后的宽限期
+var DefaultSignGrace = time.Minute * 5
+
+// 流式回调时结果channel的容量
+const streamBufferSize = 16
+
+// EarlyAccept时等待已应答、尚在stream中的回调的最长时间
+const earlyAcceptWait = time.Millisecond * 500
+
+var (
+	ErrInvalidSign  = errors.New("invalid sign")
+	ErrSignExpired  = errors.New("sign expired")
+	ErrClientClosed = errors.New("client closed")
+	ErrBodyTooLarge = errors.New("callback body too large")
+	ErrPublish      = errors.New("publish callback failed")
+)
 
 type WaiterInfo struct {
-	AsyncID string
-	State   string
-	ResultC chan *CallbackInfoParsed
+	AsyncID     string
+	CallbackURL string // 带签名的回调地址
+	State       string
+	ResultC     chan *CallbackInfoParsed
 }
 
 type CallbackInfo struct {
-	AsyncID    string `json:"async_id"`
-	Base64Body string `json:"base64_body"`
+	AsyncID     string              `json:"async_id"`
+	Base64Body  string              `json:"base64_body"`
+	ContentType string              `json:"content_type,omitempty"`
+	Method      string              `json:"method,omitempty"`
+	Header      map[string][]string `json:"header,omitempty"` // 按Config.ForwardHeaders过滤
+	Query       map[string][]string `json:"query,omitempty"`  // 按Config.ForwardQuery过滤，不含签名参数
+	RemoteAddr  string              `json:"remote_addr,omitempty"`
 }
 
 type CallbackInfoParsed struct {
-	MsgID string // 用于消息队列的ack
-	Body  []byte
+	MsgID       string // 用于消息队列的ack
+	Body        []byte
+	ContentType string
+	Method      string
+	Header      http.Header
+	Query       url.Values
+	RemoteAddr  string
 }
 
 type Client struct {
-	lock        sync.RWMutex
-	messager    Messager
-	waiters     map[string]*WaiterInfo
-	callbackURL string
-	maxSize     int64 // callback body的最大size
-	timeout     time.Duration
+	stats          ClientStats // 放在首位，保证32位平台上atomic操作的对齐
+	lock           sync.RWMutex
+	messager       Messager
+	ownMessager    bool // messager由client创建，close时一并关闭
+	waiters        map[string]*WaiterInfo
+	callbackURL    string
+	pathTmpl       *pathTemplate // callbackURL为路径模板时不为nil
+	signer         *signature.Signer
+	signGrace      time.Duration           // 回调地址在超时之后的宽限期
+	ackResponders  map[string]AckResponder // 名字 -> AckResponder，""为默认
+	maxSize        int64                   // callback body的最大size
+	deduper        Deduper
+	decoders       map[string]Decoder          // Content-Type -> Decoder
+	verifiers      map[string]CallbackVerifier // 名字 -> CallbackVerifier，""为默认
+	forwardHeaders []string                    // 需要转发给等待方的header，"*"为全部
+	forwardQueries []string                    // 需要转发给等待方的query参数，"*"为全部
+	dedupPolicy    DedupPolicy
+	timeout        time.Duration
+
+	resultStore     ResultStore // 持久化回调，不设置时不保存
+	resultTTL       time.Duration
+	taskIDExtractor TaskIDExtractor              // 按下游任务id关联回调，不设置时不开启
+	orphans         map[string][]*orphanCallback // 先于注册到达的回调，受lock保护
+	orphanCount     int
+
+	expiryLock sync.Mutex
+	expiries   expiryHeap // ticket的截止时间，受expiryLock保护，不占用lock
+
+	closed     bool
+	closeC     chan struct{}      // close时关闭，通知等待中的ToSync
+	cancel     context.CancelFunc // 停止listen
+	listenDone chan struct{}
+	inflight   sync.WaitGroup // 处理中的callback请求
+}
+
+// NewClient 创建独立的client，拥有自己的messager、waiters和listen协程，
+// 可以在同一进程内对接多个配置不同的下游。
+// redisCli可以是单机、Cluster、Sentinel或Ring client，通过ClientOption.SetMessager自定义消息通道时可以为nil
+func NewClient(redisCli redis.UniversalClient, cfg *Config, opts ...*ClientOption) (client *Client, err error) {
+	if cfg == nil {
+		err = errors.New("config is nil")
+		return
+	}
+	if err = cfg.Validate(); err != nil {
+		err = errors.Wrap(err, "validate config")
+		return
+	}
+	opt := mergeClientOptions(opts...)
+	// 固定地址的回调没有签名保护，必须由下游签名校验兜底
+	if opt.TaskIDExtractor != nil && opt.Verifiers[""] == nil {
+		err = errors.New("task id extractor requires a default callback verifier, use ClientOption.SetVerifier(\"\", ...)")
+		return
+	}
+	signer, err := newSigner(cfg.SignKeys)
+	if err != nil {
+		err = errors.Wrap(err, "new signer")
+		return
+	}
+	pathTmpl, err := parsePathTemplate(cfg.CallbackURL)
+	if err != nil {
+		err = errors.Wrap(err, "parse callbackURL template")
+		return
+	}
+
+	msger := opt.Messager
+	ownMessager := msger == nil
+	if msger == nil {
+		if isNilClient(redisCli) {
+			err = errors.New("redis client is nil")
+			return
+		}
+		msger, err = messager.NewRedisMessager(redisCli, cfg.Stream, &messager.RedisOption{
+			MaxAge:       time.Second * time.Duration(cfg.RetainSeconds),
+			MaxLen:       cfg.MaxStreamLen,
+			TrimInterval: time.Second * time.Duration(cfg.TrimIntervalSeconds),
+		})
+		if err != nil {
+			err = errors.Wrap(err, "new redis messager")
+			return
+		}
+	}
+	ackBody := cfg.AckBody
+	if ackBody == "" {
+		ackBody = defaultAckBody
+	}
+	ackResponders := map[string]AckResponder{"": TextAck(ackBody)}
+	for name, responder := range opt.AckResponders {
+		ackResponders[name] = responder
+	}
+	signGrace := DefaultSignGrace
+	if cfg.SignGraceSeconds > 0 {
+		signGrace = time.Second * time.Duration(cfg.SignGraceSeconds)
+	}
+
+	resultTTL := opt.ResultTTL
+	if resultTTL <= 0 {
+		resultTTL = DefaultResultTTL
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client = &Client{
+		messager:        msger,
+		ownMessager:     ownMessager,
+		waiters:         make(map[string]*WaiterInfo),
+		callbackURL:     cfg.CallbackURL,
+		pathTmpl:        pathTmpl,
+		signer:          signer,
+		signGrace:       signGrace,
+		ackResponders:   ackResponders,
+		maxSize:         cfg.MaxCallbackBytes,
+		deduper:         opt.Deduper,
+		decoders:        opt.Decoders,
+		verifiers:       opt.Verifiers,
+		taskIDExtractor: opt.TaskIDExtractor,
+		resultStore:     opt.ResultStore,
+		resultTTL:       resultTTL,
+		forwardHeaders:  cfg.ForwardHeaders,
+		forwardQueries:  cfg.ForwardQuery,
+		dedupPolicy:     opt.DedupPolicy,
+		timeout:         time.Second * time.Duration(cfg.TimeoutSeconds),
+		closeC:          make(chan struct{}),
+		cancel:          cancel,
+		listenDone:      make(chan struct{}),
+	}
+	go client.listen(ctx)
+	go client.sweepTickets()
+	return
+}
+
+// redisCli为nil，或是包着nil指针的接口（如(*redis.Client)(nil)）
+func isNilClient(redisCli redis.UniversalClient) bool {
+	if redisCli == nil {
+		return true
+	}
+	v := reflect.ValueOf(redisCli)
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return v.IsNil()
+	}
+	return false
+}
+
+// Close 关闭client：等待中的ToSync返回ErrClientClosed，不再接收新的callback；
+// 在ctx结束前等待处理中的callback完成，然后停止订阅。
+// 可重复调用。
+func (c *Client) Close(ctx context.Context) (err error) {
+	c.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.closeC)
+	}
+	c.lock.Unlock()
+
+	// 等待处理中的callback发布完成，避免滚动重启时丢回调
+	inflightDone := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(inflightDone)
+	}()
+	select {
+	case <-inflightDone:
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "wait inflight callbacks")
+	}
+
+	// 停止订阅，归还阻塞读占用的连接
+	c.cancel()
+	select {
+	case <-c.listenDone:
+	case <-ctx.Done():
+		if err == nil {
+			err = errors.Wrap(ctx.Err(), "wait listen exit")
+		}
+		return
+	}
+
+	if closer, ok := c.messager.(io.Closer); ok && c.ownMessager {
+		if cerr := closer.Close(); cerr != nil && err == nil {
+			err = errors.Wrap(cerr, "close messager")
+		}
+	}
+	return
+}
+
+// 标记一个处理中的callback，client已关闭时返回false
+func (c *Client) enter() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return false
+	}
+	c.inflight.Add(1)
+	return true
 }
 
 func (c *Client) CallbackHandler(ctx context.Context, r *http.Request) (err error) {
-	asyncID := r.URL.Query().Get("async_id")
-	sign := r.URL.Query().Get("sign")
-	random := r.URL.Query().Get("random")
+	if !c.enter() {
+		return ErrClientClosed
+	}
+	defer c.inflight.Done()
 
-	// 校验sign
-	if !signature.CheckSign(asyncID, random, sign) {
-		return ErrInvalidSign
+	// 校验sign，回调到固定地址时读取body后按下游任务id关联
+	var claims *callbackClaims
+	correlating := c.correlating(r)
+	if correlating {
+		claims = &callbackClaims{Expire: time.Now().Add(c.timeout + c.signGrace).Unix()}
+	} else {
+		claims, err = c.verifyClaims(r)
+		if err != nil {
+			return
+		}
 	}
 
 	reader := io.LimitReader(r.Body, c.maxSize+1)
@@ -62,35 +286,83 @@ func (c *Client) CallbackHandler(ctx context.Context, r *http.Request) (err erro
 		return
 	}
 	if int64(len(buf)) > c.maxSize {
-		err = errors.Errorf("body limited to %d bytes", c.maxSize)
+		err = errors.Wrapf(ErrBodyTooLarge, "body limited to %d bytes", c.maxSize)
 		return
 	}
 
+	// 校验下游的签名，伪造的回调不发布
+	if verifier := c.callbackVerifier(claims.Verifier); verifier != nil {
+		err = verifier.Verify(r, buf)
+		if err != nil {
+			err = errors.Wrapf(ErrInvalidVendorSign, "%v", err)
+			return
+		}
+	}
+	if correlating {
+		claims.AsyncID, err = c.extractTaskKey(r, buf)
+		if err != nil {
+			return
+		}
+	}
+	asyncID := claims.AsyncID
+
 	callbackInfo := new(CallbackInfo)
 	callbackInfo.AsyncID = asyncID
 	callbackInfo.Base64Body = base64.StdEncoding.EncodeToString(buf)
+	callbackInfo.ContentType = r.Header.Get("Content-Type")
+	callbackInfo.Method = r.Method
+	callbackInfo.Header = c.forwardHeader(r)
+	callbackInfo.Query = c.forwardQuery(r)
+	callbackInfo.RemoteAddr = r.RemoteAddr
 	infoBuf, err := json.Marshal(callbackInfo)
 	if err != nil {
 		err = errors.Wrap(err, "marshal callbackInfo")
 		return
 	}
 
+	// 重复的callback不再发布
+	if c.dedup(ctx, claims) {
+		logc.Infof(ctx, "[ToSync] duplicated callback data %s, async_id %s, skip pub", buf, asyncID)
+		return
+	}
+
+	// 先持久化，等待方超时或重启后仍可取回
+	if c.resultStore != nil {
+		err = c.resultStore.Save(ctx, asyncID, infoBuf, c.resultTTL)
+		if err != nil {
+			c.undedup(ctx, claims)
+			err = errors.Wrapf(ErrPublish, "save result: %v", err)
+			return
+		}
+	}
+
 	msgID, err := c.messager.Pub(ctx, infoBuf)
 	if err != nil {
-		err = errors.Wrap(err, "pub")
+		c.undedup(ctx, claims)
+		err = errors.Wrapf(ErrPublish, "pub: %v", err)
 		return
 	}
 	logc.Infof(ctx, "[ToSync] get callback data %s, async_id %s, pub to msgID %s", buf, asyncID, msgID)
 	return
 }
 
-func (c *Client) listen() {
+func (c *Client) listen(ctx context.Context) {
+	defer close(c.listenDone)
 	for {
-		ctx := context.Background()
+		if ctx.Err() != nil {
+			return
+		}
 		data, err := c.messager.DupSub(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			logc.Errorf(ctx, "[ToSync] sub error: %v", err)
-			time.Sleep(time.Millisecond * 100)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Millisecond * 100):
+			}
 			continue
 		}
 		for msgID, buf := range data {
@@ -108,72 +380,226 @@ func (c *Client) listen() {
 	}
 }
 
+// 解码body，转为交给等待方的回调
+func (info *CallbackInfo) parse(msgID string) (*CallbackInfoParsed, error) {
+	body, err := base64.StdEncoding.DecodeString(info.Base64Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode base64 body")
+	}
+	return &CallbackInfoParsed{
+		MsgID:       msgID,
+		Body:        body,
+		ContentType: info.ContentType,
+		Method:      info.Method,
+		Header:      info.Header,
+		Query:       info.Query,
+		RemoteAddr:  info.RemoteAddr,
+	}, nil
+}
+
 func (c *Client) processMsg(msgID string, buf []byte) (string, error) {
 	callbackInfo := new(CallbackInfo)
 	err := json.Unmarshal(buf, callbackInfo)
 	if err != nil {
 		return "", errors.Wrap(err, "unmarshal callbackInfo")
 	}
-	callbackBody, err := base64.StdEncoding.DecodeString(callbackInfo.Base64Body)
+	parsed, err := callbackInfo.parse(msgID)
 	if err != nil {
-		return "", errors.Wrap(err, "decode base64 body")
+		return "", err
 	}
-
+	c.lock.RLock()
 	waitInfo, ok := c.waiters[callbackInfo.AsyncID]
+	c.lock.RUnlock()
+	if !ok && c.taskIDExtractor != nil && strings.HasPrefix(callbackInfo.AsyncID, taskKeyPrefix) {
+		// 回调可能先于async返回下游任务id到达，暂存等待注册
+		waitInfo, ok = c.keepOrphan(callbackInfo.AsyncID, parsed)
+		if !ok {
+			return "task not registered yet, keep as orphan", nil
+		}
+	}
 	if !ok {
 		return "AsyncID not registed in this client", nil
 	} else {
 		select {
-		case waitInfo.ResultC <- &CallbackInfoParsed{
-			MsgID: msgID,
-			Body:  callbackBody,
-		}:
+		case waitInfo.ResultC <- parsed:
 			return "success", nil
+		default:
+		}
+		if c.dedupPolicy != DedupLastWins || c.deduper == nil {
+			return "duplicated msg and channel full", nil
+		}
+		// LastWins：丢弃未消费的旧结果，换成新结果
+		select {
+		case <-waitInfo.ResultC:
+			atomic.AddUint64(&c.stats.ReplacedResults, 1)
+		default:
+		}
+		select {
+		case waitInfo.ResultC <- parsed:
+			return "replaced previous result", nil
 		default:
 			return "duplicated msg and channel full", nil
 		}
 	}
 }
 
-func (c *Client) Regist(req ReqI) (*WaiterInfo, error) {
+func (c *Client) Regist(req ReqI, opts ...*Option) (*WaiterInfo, error) {
+	return c.regist(context.Background(), req, mergeOptions(opts...), 1)
+}
+
+// bufSize为结果channel的容量，一个任务会多次回调时需要大于1
+func (c *Client) regist(ctx context.Context, req ReqI, opt *Option, bufSize int) (*WaiterInfo, error) {
 	// 不能带有callbackURL，因为要走统一的
 	if req.GetCallbackURL() != "" {
 		return nil, errors.New("callbackURL should be empty")
 	}
-
-	//基于统一的callbackURL，拼接taskID、random、sign到callbackURL中
-	asyncID := uuid.NewString()
-	random, sign := signature.GenSign(asyncID)
-	newURL, err := url.Parse(c.callbackURL)
+	info, err := c.registURL(ctx, opt, bufSize)
 	if err != nil {
-		return nil, errors.Wrapf(err, "parse callbackURL %s", c.callbackURL)
+		return nil, err
+	}
+	req.SetCallbackURL(info.CallbackURL)
+	if tmp := req.GetCallbackURL(); tmp != info.CallbackURL {
+		c.Release(info)
+		return nil, errors.Errorf("callbackURL should be %s but %s", info.CallbackURL, tmp)
+	}
+	return info, nil
+}
+
+// 注册waiter并生成带签名的callbackURL，不要求请求实现ReqI
+func (c *Client) registURL(ctx context.Context, opt *Option, bufSize int) (*WaiterInfo, error) {
+	if _, ok := c.ackResponders[opt.Ack]; !ok {
+		return nil, errors.Errorf("ack responder %s not registered", opt.Ack)
+	}
+	if _, ok := c.verifiers[opt.Verifier]; !ok && opt.Verifier != "" {
+		return nil, errors.Errorf("callback verifier %s not registered", opt.Verifier)
 	}
-	values := newURL.Query()
-	values.Add("random", fmt.Sprintf("%d", random))
-	values.Add("sign", sign)
-	values.Add("async_id", asyncID)
-	newURL.RawQuery = values.Encode()
-	newURLStr := newURL.String()
-	req.SetCallbackURL(newURLStr)
-	if tmp := req.GetCallbackURL(); tmp != newURLStr {
-		return nil, errors.Errorf("callbackURL should be %s but %s", newURLStr, tmp)
+
+	//基于统一的callbackURL，拼接taskID、nonce、sign到callbackURL中
+	asyncID := opt.AsyncID
+	if asyncID == "" {
+		asyncID = uuid.NewString()
+	} else if err := c.checkAsyncID(ctx, asyncID); err != nil {
+		return nil, err
+	}
+	newURLStr, err := c.signedURL(asyncID, opt)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign callbackURL")
 	}
 
 	info := &WaiterInfo{
-		AsyncID: asyncID,
-		ResultC: make(chan *CallbackInfoParsed, 1),
+		AsyncID:     asyncID,
+		CallbackURL: newURLStr,
+		ResultC:     make(chan *CallbackInfoParsed, bufSize),
 	}
+	err = c.addWaiter(info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// 注册waiter，同一个async_id同时只能有一个等待方
+func (c *Client) addWaiter(info *WaiterInfo) error {
 	c.lock.Lock()
-	c.waiters[asyncID] = info
-	c.lock.Unlock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	if _, ok := c.waiters[info.AsyncID]; ok {
+		return errors.Errorf("async id %s already waiting", info.AsyncID)
+	}
+	c.waiters[info.AsyncID] = info
+	return nil
+}
 
-	return info, nil
+func (c *Client) timeoutOf(opt *Option) time.Duration {
+	if opt.Timeout > 0 {
+		return opt.Timeout
+	}
+	return c.timeout
+}
+
+// 检查调用方指定的async_id：只允许路径安全的字符，路径模式下才能原样取回；
+// 已有保存结果的async_id不能复用，否则Await、提交失败时会拿到上一次的回调
+func (c *Client) checkAsyncID(ctx context.Context, asyncID string) error {
+	// 不允许':'，也就不会与按任务id关联的key冲突
+	for _, r := range asyncID {
+		if !isUnreserved(r) {
+			return errors.Errorf("async id %s contains invalid char %q, only letters, digits and ._~- are allowed", asyncID, r)
+		}
+	}
+	if c.resultStore == nil {
+		return nil
+	}
+	_, err := c.resultStore.Load(ctx, asyncID)
+	if err == nil {
+		return errors.Errorf("async id %s already has a stored result, use Lookup or Await to get it", asyncID)
+	}
+	if !errors.Is(err, ErrResultNotFound) {
+		return errors.Wrap(err, "load result")
+	}
+	return nil
+}
+
+// RFC 3986中的unreserved字符，url.PathEscape不会转义
+func isUnreserved(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' ||
+		r == '-' || r == '.' || r == '_' || r == '~'
+}
+
+// 是否已收到回调：已投递给waiter，或已保存在ResultStore中（尚未经stream送达）
+func (c *Client) callbackArrived(info *WaiterInfo) bool {
+	if len(info.ResultC) > 0 {
+		return true
+	}
+	if c.resultStore == nil {
+		return false
+	}
+	// 提交的ctx可能已超时，单独限制读取时间
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	callbackInfo, err := c.loadResult(ctx, info.AsyncID)
+	if err != nil {
+		return false
+	}
+	select {
+	case info.ResultC <- callbackInfo:
+	default:
+	}
+	return true
+}
+
+// 已应答下游的回调可能还在stream中，最多再等d。
+// 配置ResultStore时回调先保存再应答，第一次检查就能读到
+func (c *Client) waitCallback(info *WaiterInfo, d time.Duration) bool {
+	if c.callbackArrived(info) {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	ticker := time.NewTicker(time.Millisecond * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return false
+		case <-c.closeC:
+			return false
+		case <-ticker.C:
+			if len(info.ResultC) > 0 {
+				return true
+			}
+		}
+	}
 }
 
 func (c *Client) Release(info *WaiterInfo) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	delete(c.waiters, info.AsyncID)
+	// 可能已被sweeper释放，同一个async_id又注册了新的waiter
+	if c.waiters[info.AsyncID] == info {
+		delete(c.waiters, info.AsyncID)
+	}
 }
 
 // 返回初始化好的*T类型的reflect.Value
@@ -183,7 +609,7 @@ func newParam[T any]() reflect.Value {
 	return reflect.New(tt)
 }
 
-// // 支持的T类型：map、slice、array、struct，及其指针。
+// // 支持的T类型：map、slice、array、struct、string，及其指针。
 // // 不支持：interface{}
 func checkType[T any]() error {
 	var null T
@@ -194,7 +620,7 @@ func checkType[T any]() error {
 		pointetFlag = "*"
 	}
 	switch tt.Kind() {
-	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct, reflect.String:
 		return nil
 	default:
 		return errors.Errorf("unexpected type: %s%v", pointetFlag, tt)
@@ -4,18 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"strings"
-	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/huaiyann/congroup/v2"
-	"github.com/huaiyann/tosync/internal/signature"
 	"github.com/pkg/errors"
 	"github.com/redis/go-redis/v9"
 )
@@ -38,14 +35,16 @@ type TestCallbackData struct {
 	Msg string `json:"msg"`
 }
 
-// 测试用http server
-var callbackPort int
-var startOnce sync.Once
+// 测试用签名密钥
+var testSignKeys = []SignKey{{ID: "test", Secret: "0123456789abcdef"}}
 
-func startServer() {
-	callbackPort = 10000 + rand.Intn(10000)
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		err := CallbackHandler(r.Context(), r)
+// 测试用消息流，同一测试内的多个client共享
+var testStream = NewMemoryStream()
+
+// 测试用client，使用进程内消息流，callback地址指向该client独立的http server
+func newTestClient(t *testing.T, maxCallbackBytes int64, timeoutSeconds int, opts ...*ClientOption) (client *Client, callbackURL string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := client.CallbackHandler(r.Context(), r)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
@@ -53,31 +52,64 @@ func startServer() {
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+
+	callbackURL = server.URL + "/callback"
+	client, err := NewClient(nil, &Config{
+		CallbackURL:      callbackURL,
+		MaxCallbackBytes: maxCallbackBytes,
+		Stream:           "to_sync_test",
+		TimeoutSeconds:   timeoutSeconds,
+		SignKeys:         testSignKeys,
+	}, append([]*ClientOption{new(ClientOption).SetMessager(NewMemoryMessager(testStream))}, opts...)...)
+	if err != nil {
+		t.Fatalf("new tosync client failed: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close(context.Background())
 	})
-	http.ListenAndServe(fmt.Sprintf(":%d", callbackPort), nil)
+	return
 }
 
-// 验证正常逻辑
-func TestToSync(t *testing.T) {
-	go startOnce.Do(startServer)
-	ctx := context.Background()
-	cli := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	err := cli.Ping(ctx).Err()
-	if err != nil {
-		t.Fatalf("ping redis failed: %v", err)
+// 非指针实现的redis client
+type valueRedisClient struct {
+	redis.UniversalClient
+}
+
+func TestIsNilClient(t *testing.T) {
+	cases := []struct {
+		cli  redis.UniversalClient
+		want bool
+	}{
+		{nil, true},
+		{(*redis.Client)(nil), true},
+		{redis.NewClient(&redis.Options{}), false},
+		{valueRedisClient{}, false},
 	}
-	defaultClient = nil
-	err = Init(cli, &Config{
-		CallbackURL:      fmt.Sprintf("http://localhost:%d/callback", callbackPort),
-		MaxCallbackBytes: 1024 * 1024,
+	for i, c := range cases {
+		if get := isNilClient(c.cli); get != c.want {
+			t.Fatalf("case %d: want %v, get %v", i, c.want, get)
+		}
+	}
+
+	_, err := NewClient((*redis.Client)(nil), &Config{
+		CallbackURL:      "http://localhost/callback",
+		MaxCallbackBytes: 1024,
 		Stream:           "to_sync_test",
 		TimeoutSeconds:   10,
+		SignKeys:         testSignKeys,
 	})
-	if err != nil {
-		t.Fatalf("init tosync failed: %v", err)
+	if err == nil || !strings.Contains(err.Error(), "redis client is nil") {
+		t.Fatalf("want redis client is nil, get %v", err)
 	}
+}
+
+// 验证正常逻辑
+func TestToSync(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client)
 
 	cg := congroup.New(ctx)
 
@@ -87,6 +119,7 @@ func TestToSync(t *testing.T) {
 		for data := range c {
 			callbcak := data["callback"]
 			var buf []byte
+			var err error
 			if data["type"] == "slice" {
 				buf, err = json.Marshal([]string{data["msg"]})
 				if err != nil {
@@ -120,7 +153,7 @@ func TestToSync(t *testing.T) {
 				"msg":      msg,
 			}
 			return nil
-		})
+		}, opt)
 		if err != nil {
 			t.Fatalf("tosync failed: %v", err)
 		}
@@ -138,7 +171,7 @@ func TestToSync(t *testing.T) {
 				"msg":      msg,
 			}
 			return nil
-		})
+		}, opt)
 		if err != nil {
 			t.Fatalf("tosync failed: %v", err)
 		}
@@ -156,7 +189,7 @@ func TestToSync(t *testing.T) {
 				"msg":      msg,
 			}
 			return nil
-		})
+		}, opt)
 		if err != nil {
 			t.Fatalf("tosync failed: %v", err)
 		}
@@ -174,7 +207,7 @@ func TestToSync(t *testing.T) {
 				"msg":      msg,
 			}
 			return nil
-		})
+		}, opt)
 		if err != nil {
 			t.Fatalf("tosync failed: %v", err)
 		}
@@ -193,7 +226,7 @@ func TestToSync(t *testing.T) {
 				"type":     "slice",
 			}
 			return nil
-		})
+		}, opt)
 		if err != nil {
 			t.Fatalf("tosync failed: %v", err)
 		}
@@ -212,7 +245,7 @@ func TestToSync(t *testing.T) {
 				"type":     "slice",
 			}
 			return nil
-		})
+		}, opt)
 		if err != nil {
 			t.Fatalf("tosync failed: %v", err)
 		}
@@ -231,7 +264,7 @@ func TestToSync(t *testing.T) {
 				"type":     "slice",
 			}
 			return nil
-		})
+		}, opt)
 		if err != nil {
 			t.Fatalf("tosync failed: %v", err)
 		}
@@ -250,7 +283,7 @@ func TestToSync(t *testing.T) {
 				"type":     "slice",
 			}
 			return nil
-		})
+		}, opt)
 		if err != nil {
 			t.Fatalf("tosync failed: %v", err)
 		}
@@ -261,7 +294,7 @@ func TestToSync(t *testing.T) {
 	})
 	<-time.After(time.Second)
 	close(c)
-	err = cg.Wait()
+	err := cg.Wait()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -269,37 +302,9 @@ func TestToSync(t *testing.T) {
 
 // 验证两个client同时消费
 func TestToSyncMultiClient(t *testing.T) {
-	go startOnce.Do(startServer)
 	ctx := context.Background()
-	cli := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	err := cli.Ping(ctx).Err()
-	if err != nil {
-		t.Fatalf("ping redis failed: %v", err)
-	}
-	defaultClient = nil
-	err = Init(cli, &Config{
-		CallbackURL:      fmt.Sprintf("http://localhost:%d/callback", callbackPort),
-		MaxCallbackBytes: 1024 * 1024,
-		Stream:           "to_sync_test",
-		TimeoutSeconds:   10,
-	})
-	if err != nil {
-		t.Fatalf("init tosync failed: %v", err)
-	}
-	client1 := defaultClient
-	defaultClient = nil
-	err = Init(cli, &Config{
-		CallbackURL:      fmt.Sprintf("http://localhost:%d/callback", callbackPort),
-		MaxCallbackBytes: 1024 * 1024,
-		Stream:           "to_sync_test",
-		TimeoutSeconds:   10,
-	})
-	if err != nil {
-		t.Fatalf("init tosync failed: %v", err)
-	}
-	client2 := defaultClient
+	client1, _ := newTestClient(t, 1024*1024, 10)
+	client2, _ := newTestClient(t, 1024*1024, 10)
 
 	cg := congroup.New(ctx)
 
@@ -309,6 +314,7 @@ func TestToSyncMultiClient(t *testing.T) {
 		for data := range c {
 			callbcak := data["callback"]
 			var buf []byte
+			var err error
 			if data["type"] == "slice" {
 				buf, err = json.Marshal([]string{data["msg"]})
 				if err != nil {
@@ -375,7 +381,7 @@ func TestToSyncMultiClient(t *testing.T) {
 	}
 	<-time.After(time.Second)
 	close(c)
-	err = cg.Wait()
+	err := cg.Wait()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -383,30 +389,14 @@ func TestToSyncMultiClient(t *testing.T) {
 
 // 验证超时
 func TestToSyncTimeout(t *testing.T) {
-	go startOnce.Do(startServer)
 	ctx := context.Background()
-	cli := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	err := cli.Ping(ctx).Err()
-	if err != nil {
-		t.Fatalf("ping redis failed: %v", err)
-	}
-	defaultClient = nil
-	err = Init(cli, &Config{
-		CallbackURL:      fmt.Sprintf("http://localhost:%d/callback", callbackPort),
-		MaxCallbackBytes: 1024 * 1024,
-		Stream:           "to_sync_test",
-		TimeoutSeconds:   1,
-	})
-	if err != nil {
-		t.Fatalf("init tosync failed: %v", err)
-	}
+	client, _ := newTestClient(t, 1024*1024, 1)
+	opt := new(Option).SetClient(client)
 	// 默认超时
 	start := time.Now()
-	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+	_, err := ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
 		return nil
-	})
+	}, opt)
 	if !errors.Is(err, context.DeadlineExceeded) {
 		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
 	}
@@ -420,7 +410,7 @@ func TestToSyncTimeout(t *testing.T) {
 	timeout := time.Millisecond * 500
 	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
 		return nil
-	}, new(Option).SetTimeout(timeout))
+	}, opt, new(Option).SetTimeout(timeout))
 	if !errors.Is(err, context.DeadlineExceeded) {
 		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
 	}
@@ -434,7 +424,7 @@ func TestToSyncTimeout(t *testing.T) {
 	timeout = time.Millisecond * 1500
 	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
 		return nil
-	}, new(Option).SetTimeout(timeout))
+	}, opt, new(Option).SetTimeout(timeout))
 	if !errors.Is(err, context.DeadlineExceeded) {
 		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
 	}
@@ -446,27 +436,9 @@ func TestToSyncTimeout(t *testing.T) {
 
 // 验证callback异常
 func TestToSyncCallbackErr(t *testing.T) {
-	go startOnce.Do(startServer)
-	ctx := context.Background()
-	cli := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	err := cli.Ping(ctx).Err()
-	if err != nil {
-		t.Fatalf("ping redis failed: %v", err)
-	}
-	defaultClient = nil
-	err = Init(cli, &Config{
-		CallbackURL:      fmt.Sprintf("http://localhost:%d/callback", callbackPort),
-		MaxCallbackBytes: 10,
-		Stream:           "to_sync_test",
-		TimeoutSeconds:   10,
-	})
-	if err != nil {
-		t.Fatalf("init tosync failed: %v", err)
-	}
+	client, callbackURL := newTestClient(t, 10, 10)
 	// sign不对
-	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/callback", callbackPort),
+	resp, err := http.Post(callbackURL,
 		"application/json", strings.NewReader("12345678901"))
 	if err != nil {
 		t.Fatalf("post failed: %v", err)
@@ -483,8 +455,11 @@ func TestToSyncCallbackErr(t *testing.T) {
 	}
 
 	// body过大
-	random, sign := signature.GenSign("async_id")
-	resp, err = http.Post(fmt.Sprintf("http://localhost:%d/callback?async_id=async_id&random=%d&sign=%s", callbackPort, random, sign),
+	signedURL, err := client.signedURL("async_id", new(Option))
+	if err != nil {
+		t.Fatalf("sign url failed: %v", err)
+	}
+	resp, err = http.Post(signedURL,
 		"application/json", strings.NewReader("12345678901"))
 	if err != nil {
 		t.Fatalf("post failed: %v", err)
@@ -504,30 +479,326 @@ func TestToSyncCallbackErr(t *testing.T) {
 // 验证不支持的类型
 func TestToSyncNotSupportType(t *testing.T) {
 	ctx := context.Background()
-	cli := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	err := cli.Ping(ctx).Err()
+	client, _ := newTestClient(t, 10, 10)
+	opt := new(Option).SetClient(client)
+	_, err := ToSync[*TestReq, int](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		return nil
+	}, opt)
+	if err == nil {
+		t.Fatalf("expect error")
+	}
+	if want := "unexpected type: int"; !strings.Contains(err.Error(), want) {
+		t.Fatalf("want %s, get %s", want, err.Error())
+	}
+}
+
+// 验证关闭client
+func TestClientClose(t *testing.T) {
+	ctx := context.Background()
+	client, callbackURL := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client)
+
+	// 等待中的ToSync返回ErrClientClosed
+	errC := make(chan error, 1)
+	submitted := make(chan struct{})
+	go func() {
+		_, err := ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+			close(submitted)
+			return nil
+		}, opt)
+		errC <- err
+	}()
+	<-submitted
+	closeCtx, cancel := context.WithTimeout(ctx, time.Second*3)
+	defer cancel()
+	err := client.Close(closeCtx)
 	if err != nil {
-		t.Fatalf("ping redis failed: %v", err)
+		t.Fatalf("close failed: %v", err)
+	}
+	select {
+	case err = <-errC:
+		if !errors.Is(err, ErrClientClosed) {
+			t.Fatalf("want %v, get %v", ErrClientClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ToSync not returned after close")
 	}
-	defaultClient = nil
-	err = Init(cli, &Config{
-		CallbackURL:      fmt.Sprintf("http://localhost:%d/callback", callbackPort),
-		MaxCallbackBytes: 10,
+
+	// 关闭后不再接收callback
+	resp, err := http.Post(callbackURL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body failed: %v", err)
+	}
+	if !strings.Contains(string(buf), ErrClientClosed.Error()) {
+		t.Fatalf("want %s, get %s", ErrClientClosed, string(buf))
+	}
+
+	// 重复关闭
+	err = client.Close(closeCtx)
+	if err != nil {
+		t.Fatalf("close again failed: %v", err)
+	}
+}
+
+// 验证Shutdown后可以重新Init
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		CallbackURL:      "http://localhost/callback",
+		MaxCallbackBytes: 1024 * 1024,
 		Stream:           "to_sync_test",
 		TimeoutSeconds:   10,
-	})
+		SignKeys:         testSignKeys,
+	}
+	for i := 0; i < 2; i++ {
+		err := Init(nil, cfg, new(ClientOption).SetMessager(NewMemoryMessager(nil)))
+		if err != nil {
+			t.Fatalf("init tosync failed: %v", err)
+		}
+		err = Init(nil, cfg, new(ClientOption).SetMessager(NewMemoryMessager(nil)))
+		if err == nil {
+			t.Fatal("expect error")
+		}
+		err = Shutdown(ctx)
+		if err != nil {
+			t.Fatalf("shutdown failed: %v", err)
+		}
+	}
+}
+
+// 验证多次回调
+func TestToStream(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client)
+
+	msgs := []string{"accepted", "processing", "done", "ignored"}
+	events, err := ToStream[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		go func() {
+			for _, msg := range msgs {
+				buf, _ := json.Marshal(&TestCallbackData{Msg: msg})
+				resp, err := http.Post(req.GetCallbackURL(), "application/json", bytes.NewBuffer(buf))
+				if err != nil {
+					t.Errorf("post callback failed: %v", err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}, func(data TestCallbackData) bool {
+		return data.Msg == "done"
+	}, opt)
 	if err != nil {
-		t.Fatalf("init tosync failed: %v", err)
+		t.Fatalf("tostream failed: %v", err)
+	}
+
+	var get []string
+	for event := range events {
+		if event.Err != nil {
+			t.Fatalf("get event error: %v", event.Err)
+		}
+		get = append(get, event.Data.Msg)
+		if event.Final != (event.Data.Msg == "done") {
+			t.Fatalf("unexpected final %v for %s", event.Final, event.Data.Msg)
+		}
+	}
+	if want := msgs[:3]; strings.Join(get, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v, get %v", want, get)
 	}
-	_, err = ToSync[*TestReq, string](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+
+	// 超时后返回错误并关闭
+	events, err = ToStream[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
 		return nil
-	})
-	if err == nil {
-		t.Fatalf("expect error")
+	}, func(data TestCallbackData) bool {
+		return true
+	}, opt, new(Option).SetTimeout(time.Millisecond*200))
+	if err != nil {
+		t.Fatalf("tostream failed: %v", err)
 	}
-	if want := "unexpected type: string"; !strings.Contains(err.Error(), want) {
-		t.Fatalf("want %s, get %s", want, err.Error())
+	event := <-events
+	if !errors.Is(event.Err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, get %v", context.DeadlineExceeded, event.Err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("want events closed")
+	}
+}
+
+// 验证忽略非终态的回调
+func TestToSyncDoneWhen(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client)
+
+	post := func(callbackURL string, msgs ...string) {
+		go func() {
+			for _, msg := range msgs {
+				buf, _ := json.Marshal(&TestCallbackData{Msg: msg})
+				resp, err := http.Post(callbackURL, "application/json", bytes.NewBuffer(buf))
+				if err != nil {
+					t.Errorf("post callback failed: %v", err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+
+	data, err := ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		post(req.GetCallbackURL(), "processing", "processing", "done")
+		return nil
+	}, opt, DoneWhen(func(data TestCallbackData) (bool, error) {
+		return data.Msg != "processing", nil
+	}))
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "done" {
+		t.Fatalf("want done, get %s", data.Msg)
+	}
+
+	// 终态判断返回错误
+	failed := errors.New("task failed")
+	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		post(req.GetCallbackURL(), "processing", "failed")
+		return nil
+	}, opt, DoneWhen(func(data TestCallbackData) (bool, error) {
+		if data.Msg == "failed" {
+			return true, failed
+		}
+		return false, nil
+	}))
+	if !errors.Is(err, failed) {
+		t.Fatalf("want %v, get %v", failed, err)
+	}
+
+	// 类型不一致
+	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		return nil
+	}, opt, DoneWhen(func(data *TestCallbackData) (bool, error) {
+		return true, nil
+	}))
+	if err == nil || !strings.Contains(err.Error(), "not match CallbackData") {
+		t.Fatalf("want type not match error, get %v", err)
+	}
+}
+
+func TestToSyncFunc(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client)
+
+	// callbackURL放在header中
+	header := make(http.Header)
+	data, err := ToSyncFunc[TestCallbackData](ctx, func(ctx context.Context, callbackURL string) error {
+		header.Set("X-Notify-URL", callbackURL)
+		go func() {
+			resp, err := http.Post(header.Get("X-Notify-URL"), "application/json", strings.NewReader(`{"msg":"ok"}`))
+			if err != nil {
+				t.Errorf("post callback failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return nil
+	}, opt)
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "ok" {
+		t.Fatalf("want ok, get %s", data.Msg)
+	}
+
+	// 提交失败
+	submitErr := errors.New("submit failed")
+	_, err = ToSyncFunc[TestCallbackData](ctx, func(ctx context.Context, callbackURL string) error {
+		return submitErr
+	}, opt)
+	if !errors.Is(err, submitErr) {
+		t.Fatalf("want %v, get %v", submitErr, err)
+	}
+	if len(client.waiters) != 0 {
+		t.Fatalf("want waiters released, get %d", len(client.waiters))
+	}
+}
+
+func TestToSyncEarlyAccept(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t, 1024*1024, 10)
+	opt := new(Option).SetClient(client)
+	submitErr := errors.New("submit failed")
+
+	// 先回调，再返回提交失败
+	async := func(ctx context.Context, req *TestReq) error {
+		resp, err := http.Post(req.GetCallbackURL(), "application/json", strings.NewReader(`{"msg":"early"}`))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		time.Sleep(time.Millisecond * 50)
+		return submitErr
+	}
+	data, err := ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, async, opt, new(Option).SetEarlyAccept(true))
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "early" {
+		t.Fatalf("want early, get %s", data.Msg)
+	}
+
+	// 提交失败先返回，回调随后才经stream送达
+	data, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		go func() {
+			time.Sleep(time.Millisecond * 50)
+			resp, err := http.Post(req.GetCallbackURL(), "application/json", strings.NewReader(`{"msg":"in flight"}`))
+			if err != nil {
+				t.Errorf("post callback failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return submitErr
+	}, opt, new(Option).SetEarlyAccept(true))
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "in flight" {
+		t.Fatalf("want in flight, get %s", data.Msg)
+	}
+
+	// 未开启时原样返回提交的错误
+	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, async, opt)
+	if !errors.Is(err, submitErr) || strings.Contains(err.Error(), "callback") {
+		t.Fatalf("want %v, get %v", submitErr, err)
+	}
+
+	// 提交在客户端超时，回调已到达
+	data, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		resp, err := http.Post(req.GetCallbackURL(), "application/json", strings.NewReader(`{"msg":"before timeout"}`))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		<-ctx.Done()
+		return ctx.Err()
+	}, opt, new(Option).SetEarlyAccept(true).SetTimeout(time.Millisecond*100))
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "before timeout" {
+		t.Fatalf("want before timeout, get %s", data.Msg)
+	}
+
+	// 没有回调
+	_, err = ToSync[*TestReq, TestCallbackData](ctx, &TestReq{}, func(ctx context.Context, req *TestReq) error {
+		return submitErr
+	}, opt, new(Option).SetEarlyAccept(true))
+	if !errors.Is(err, submitErr) || strings.Contains(err.Error(), "callback") {
+		t.Fatalf("want %v, get %v", submitErr, err)
 	}
 }
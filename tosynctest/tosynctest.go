@@ -0,0 +1,248 @@
+// Package tosynctest 提供进程内模拟的异步下游，用于测试调用了tosync.ToSync的代码：
+// 捕获req中的callbackURL，并按脚本回调（延迟、重复、格式错误、伪造签名或永不回调）。
+package tosynctest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/huaiyann/tosync"
+)
+
+const DefaultCallbackURL = "http://tosynctest.local/callback"
+
+// Step 一次回调
+type Step struct {
+	Delay       time.Duration // 提交后多久回调
+	ContentType string
+	Header      http.Header
+	Body        []byte
+	Forge       bool // 篡改回调地址中的签名，模拟伪造的回调
+}
+
+// Reply 回调json序列化后的v，序列化失败时测试失败
+func Reply(t testing.TB, v any) Step {
+	t.Helper()
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal reply failed: %v", err)
+	}
+	return ReplyRaw("application/json", buf)
+}
+
+// ReplyRaw 原样回调body
+func ReplyRaw(contentType string, body []byte) Step {
+	return Step{
+		ContentType: contentType,
+		Body:        body,
+	}
+}
+
+// Malformed 回调无法解析的json
+func Malformed() Step {
+	return ReplyRaw("application/json", []byte("{malformed"))
+}
+
+// After 延迟d后回调
+func (s Step) After(d time.Duration) Step {
+	s.Delay = d
+	return s
+}
+
+// Forged 用错误的签名回调
+func (s Step) Forged() Step {
+	s.Forge = true
+	return s
+}
+
+// Times 重复回调n次，模拟下游重试
+func (s Step) Times(n int) []Step {
+	steps := make([]Step, 0, n)
+	for i := 0; i < n; i++ {
+		steps = append(steps, s)
+	}
+	return steps
+}
+
+// Delivery 一次回调的结果
+type Delivery struct {
+	Step   Step
+	Status int
+	Body   string
+}
+
+// Call 一次提交
+type Call struct {
+	CallbackURL string
+	Deliveries  []*Delivery
+}
+
+// Provider 模拟的异步下游，回调直接调用client的HTTPHandler，不经过网络
+type Provider struct {
+	Client *tosync.Client
+
+	lock  sync.Mutex
+	calls []*Call
+	wg    sync.WaitGroup
+	stop  chan struct{}
+}
+
+// DefaultConfig 测试用配置，签名密钥随机生成
+func DefaultConfig(t testing.TB) *tosync.Config {
+	t.Helper()
+	secret := make([]byte, 16)
+	_, err := rand.Read(secret)
+	if err != nil {
+		t.Fatalf("generate sign secret failed: %v", err)
+	}
+	return &tosync.Config{
+		CallbackURL:      DefaultCallbackURL,
+		MaxCallbackBytes: 1024 * 1024,
+		Stream:           "tosynctest",
+		TimeoutSeconds:   10,
+		SignKeys:         []tosync.SignKey{{ID: "test", Secret: hex.EncodeToString(secret)}},
+	}
+}
+
+// New 创建使用进程内消息通道的client，cfg为nil时使用DefaultConfig，测试结束时自动关闭
+func New(t testing.TB, cfg *tosync.Config, opts ...*tosync.ClientOption) *Provider {
+	t.Helper()
+	if cfg == nil {
+		cfg = DefaultConfig(t)
+	}
+	opts = append([]*tosync.ClientOption{new(tosync.ClientOption).SetMessager(tosync.NewMemoryMessager(nil))}, opts...)
+	client, err := tosync.NewClient(nil, cfg, opts...)
+	if err != nil {
+		t.Fatalf("new tosync client failed: %v", err)
+	}
+	p := &Provider{
+		Client: client,
+		stop:   make(chan struct{}),
+	}
+	t.Cleanup(func() {
+		close(p.stop)
+		p.wg.Wait()
+		client.Close(context.Background())
+	})
+	return p
+}
+
+// Option 让ToSync使用该Provider的client
+func (p *Provider) Option() *tosync.Option {
+	return new(tosync.Option).SetClient(p.Client)
+}
+
+// Async 返回可以直接传给tosync.ToSync的async函数：记录callbackURL，并按steps异步回调，
+// steps为空时永不回调
+func Async[Req tosync.ReqI](p *Provider, steps ...Step) func(context.Context, Req) error {
+	return func(ctx context.Context, req Req) error {
+		p.Schedule(req.GetCallbackURL(), steps...)
+		return nil
+	}
+}
+
+// Fail 返回提交失败的async函数，不会回调
+func Fail[Req tosync.ReqI](err error) func(context.Context, Req) error {
+	return func(ctx context.Context, req Req) error {
+		return err
+	}
+}
+
+// Schedule 记录一次提交，并按steps异步回调callbackURL
+func (p *Provider) Schedule(callbackURL string, steps ...Step) *Call {
+	call := &Call{CallbackURL: callbackURL}
+	p.lock.Lock()
+	p.calls = append(p.calls, call)
+	p.lock.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		start := time.Now()
+		for _, step := range steps {
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(time.Until(start.Add(step.Delay))):
+			}
+			delivery := p.Deliver(callbackURL, step)
+			p.lock.Lock()
+			call.Deliveries = append(call.Deliveries, delivery)
+			p.lock.Unlock()
+		}
+	}()
+	return call
+}
+
+// Deliver 立即回调callbackURL
+func (p *Provider) Deliver(callbackURL string, step Step) *Delivery {
+	if step.Forge {
+		callbackURL = forge(p.Client.CallbackPattern(), callbackURL)
+	}
+	r := httptest.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(step.Body))
+	for key, values := range step.Header {
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	if step.ContentType != "" {
+		r.Header.Set("Content-Type", step.ContentType)
+	}
+	w := httptest.NewRecorder()
+	p.Client.HTTPHandler().ServeHTTP(w, r)
+	return &Delivery{
+		Step:   step,
+		Status: w.Code,
+		Body:   w.Body.String(),
+	}
+}
+
+// Wait 等待已安排的回调全部完成
+func (p *Provider) Wait() {
+	p.wg.Wait()
+}
+
+// Calls 返回全部提交记录
+func (p *Provider) Calls() []*Call {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	calls := make([]*Call, 0, len(p.calls))
+	for _, call := range p.calls {
+		tmp := *call
+		tmp.Deliveries = append([]*Delivery(nil), call.Deliveries...)
+		calls = append(calls, &tmp)
+	}
+	return calls
+}
+
+// 篡改回调地址中的签名，路径模式时替换{sig}所在的段
+func forge(pattern, callbackURL string) string {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return callbackURL
+	}
+	patternSegments := strings.Split(pattern, "/")
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range patternSegments {
+		if segment == "{sig}" && len(segments) == len(patternSegments) {
+			segments[i] = "forged"
+			u.Path = strings.Join(segments, "/")
+			u.RawPath = ""
+			return u.String()
+		}
+	}
+	values := u.Query()
+	values.Set("sign", "forged")
+	u.RawQuery = values.Encode()
+	return u.String()
+}
@@ -0,0 +1,126 @@
+package tosynctest
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huaiyann/tosync"
+	"github.com/pkg/errors"
+)
+
+type testReq struct {
+	CallbackURL string
+}
+
+func (t *testReq) SetCallbackURL(url string) {
+	t.CallbackURL = url
+}
+
+func (t *testReq) GetCallbackURL() string {
+	return t.CallbackURL
+}
+
+type testData struct {
+	Msg string `json:"msg"`
+}
+
+func TestProviderReply(t *testing.T) {
+	ctx := context.Background()
+	p := New(t, nil)
+
+	// 延迟回调
+	data, err := tosync.ToSync[*testReq, testData](ctx, &testReq{},
+		Async[*testReq](p, Reply(t, testData{Msg: "done"}).After(time.Millisecond*100)), p.Option())
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "done" {
+		t.Fatalf("want done, get %s", data.Msg)
+	}
+
+	// 重复回调，取第一次
+	data, err = tosync.ToSync[*testReq, testData](ctx, &testReq{},
+		Async[*testReq](p, Reply(t, testData{Msg: "dup"}).Times(3)...), p.Option())
+	if err != nil {
+		t.Fatalf("tosync failed: %v", err)
+	}
+	if data.Msg != "dup" {
+		t.Fatalf("want dup, get %s", data.Msg)
+	}
+	p.Wait()
+	calls := p.Calls()
+	if len(calls) != 2 || len(calls[1].Deliveries) != 3 {
+		t.Fatalf("unexpected calls %+v", calls)
+	}
+	for _, delivery := range calls[1].Deliveries {
+		if delivery.Status != http.StatusOK {
+			t.Fatalf("want %d, get %d", http.StatusOK, delivery.Status)
+		}
+	}
+}
+
+func TestProviderAbnormal(t *testing.T) {
+	ctx := context.Background()
+	p := New(t, nil)
+	opt := p.Option().SetTimeout(time.Millisecond * 300)
+
+	// 格式错误
+	_, err := tosync.ToSync[*testReq, testData](ctx, &testReq{}, Async[*testReq](p, Malformed()), opt)
+	if err == nil || !strings.Contains(err.Error(), "unmarshal callback body") {
+		t.Fatalf("want unmarshal error, get %v", err)
+	}
+
+	// 永不回调
+	_, err = tosync.ToSync[*testReq, testData](ctx, &testReq{}, Async[*testReq](p), opt)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
+	}
+
+	// 伪造签名的回调被拒绝
+	_, err = tosync.ToSync[*testReq, testData](ctx, &testReq{}, Async[*testReq](p, Reply(t, testData{}).Forged()), opt)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
+	}
+	p.Wait()
+	calls := p.Calls()
+	if status := calls[len(calls)-1].Deliveries[0].Status; status != http.StatusForbidden {
+		t.Fatalf("want %d, get %d", http.StatusForbidden, status)
+	}
+
+	// 提交失败
+	submitErr := errors.New("submit failed")
+	_, err = tosync.ToSync[*testReq, testData](ctx, &testReq{}, Fail[*testReq](submitErr), opt)
+	if !errors.Is(err, submitErr) {
+		t.Fatalf("want %v, get %v", submitErr, err)
+	}
+}
+
+func TestProviderPathURL(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig(t)
+	cfg.CallbackURL = "http://tosynctest.local/cb/{async_id}/{sig}"
+	p := New(t, cfg)
+	opt := p.Option().SetTimeout(time.Millisecond * 300)
+
+	data, err := tosync.ToSync[*testReq, testData](ctx, &testReq{}, Async[*testReq](p, Reply(t, testData{Msg: "ok"})), opt)
+	if err != nil {
+		t.Fatalf("to sync failed: %v", err)
+	}
+	if data.Msg != "ok" {
+		t.Fatalf("want ok, get %s", data.Msg)
+	}
+
+	// 伪造路径中的签名
+	_, err = tosync.ToSync[*testReq, testData](ctx, &testReq{}, Async[*testReq](p, Reply(t, testData{}).Forged()), opt)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, get %v", context.DeadlineExceeded, err)
+	}
+	p.Wait()
+	calls := p.Calls()
+	if status := calls[len(calls)-1].Deliveries[0].Status; status != http.StatusForbidden {
+		t.Fatalf("want %d, get %d", http.StatusForbidden, status)
+	}
+}
@@ -0,0 +1,190 @@
+package tosync
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 路径模式的回调地址占位符
+const (
+	pathAsyncID = "{async_id}"
+	pathSig     = "{sig}"
+)
+
+// 路径模式的回调地址模板，如 https://host/cb/{async_id}/{sig}，
+// 写法与net/http 1.22路由pattern中的通配段一致，适用于不接受query参数或限制地址长度的下游
+type pathTemplate struct {
+	segments []string // 模板路径按"/"切分
+	asyncIdx int      // {async_id}所在的段，-1时async_id放在签名中
+	sigIdx   int      // {sig}所在的段
+}
+
+// 解析callbackURL中的路径模板，不含占位符时返回nil，使用query参数模式
+func parsePathTemplate(callbackURL string) (*pathTemplate, error) {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse callbackURL %s", callbackURL)
+	}
+	if strings.ContainsAny(u.Host+u.RawQuery+u.Fragment, "{}") {
+		return nil, errors.Errorf("placeholder only supported in path of callbackURL %s", callbackURL)
+	}
+	if !strings.ContainsAny(u.Path, "{}") {
+		return nil, nil
+	}
+
+	tmpl := &pathTemplate{
+		segments: strings.Split(u.Path, "/"),
+		asyncIdx: -1,
+		sigIdx:   -1,
+	}
+	for i, segment := range tmpl.segments {
+		if !strings.ContainsAny(segment, "{}") {
+			continue
+		}
+		switch {
+		case segment == pathAsyncID && tmpl.asyncIdx < 0:
+			tmpl.asyncIdx = i
+		case segment == pathSig && tmpl.sigIdx < 0:
+			tmpl.sigIdx = i
+		default:
+			return nil, errors.Errorf("path segment %s not support, only %s and %s once as a whole segment", segment, pathAsyncID, pathSig)
+		}
+	}
+	if tmpl.sigIdx < 0 {
+		return nil, errors.Errorf("%s missing in path of callbackURL %s", pathSig, callbackURL)
+	}
+	return tmpl, nil
+}
+
+// 把签名后的参数填入模板
+func (t *pathTemplate) encode(callbackURL string, claims *callbackClaims) (string, error) {
+	token, err := claims.compact(t.asyncIdx < 0)
+	if err != nil {
+		return "", errors.Wrap(err, "compact claims")
+	}
+	newURL := strings.Replace(callbackURL, pathSig, token, 1)
+	if t.asyncIdx >= 0 {
+		newURL = strings.Replace(newURL, pathAsyncID, url.PathEscape(claims.AsyncID), 1)
+	}
+	return newURL, nil
+}
+
+// 从请求路径中取出参数，路径与模板不匹配时返回空的claims
+func (t *pathTemplate) decode(path string) *callbackClaims {
+	segments := strings.Split(path, "/")
+	if len(segments) != len(t.segments) {
+		return new(callbackClaims)
+	}
+	for i, segment := range t.segments {
+		if i != t.asyncIdx && i != t.sigIdx && segment != segments[i] {
+			return new(callbackClaims)
+		}
+	}
+	claims, ok := parseCompact(segments[t.sigIdx], t.asyncIdx < 0)
+	if !ok {
+		return new(callbackClaims)
+	}
+	if t.asyncIdx >= 0 {
+		claims.AsyncID = segments[t.asyncIdx]
+	}
+	return claims
+}
+
+// 模板路径，可直接用于http.ServeMux的pattern
+func (t *pathTemplate) pattern() string {
+	return strings.Join(t.segments, "/")
+}
+
+// 紧凑编码的签名：base64url(长度前缀的参数) + "." + base64url(hmac)，
+// nonce和sign按原始字节编码，解码时拒绝非规范的base64，保证同一签名只有一种写法
+func (c *callbackClaims) compact(withAsyncID bool) (string, error) {
+	nonce, err := hex.DecodeString(c.Nonce)
+	if err != nil {
+		return "", errors.Wrap(err, "decode nonce")
+	}
+	sign, err := hex.DecodeString(c.Sign)
+	if err != nil {
+		return "", errors.Wrap(err, "decode sign")
+	}
+	var payload []byte
+	fields := [][]byte{[]byte(c.KeyID), nonce, []byte(strconv.FormatInt(c.Expire, 10)), []byte(c.Ack), []byte(c.Verifier)}
+	if withAsyncID {
+		fields = append(fields, []byte(c.AsyncID))
+	}
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, field := range fields {
+		n := binary.PutUvarint(lenBuf, uint64(len(field)))
+		payload = append(payload, lenBuf[:n]...)
+		payload = append(payload, field...)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sign), nil
+}
+
+func parseCompact(token string, withAsyncID bool) (*callbackClaims, bool) {
+	encodedPayload, encodedSign, found := strings.Cut(token, ".")
+	if !found {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.Strict().DecodeString(encodedPayload)
+	if err != nil {
+		return nil, false
+	}
+	sign, err := base64.RawURLEncoding.Strict().DecodeString(encodedSign)
+	if err != nil {
+		return nil, false
+	}
+
+	count := 5
+	if withAsyncID {
+		count++
+	}
+	fields := make([]string, 0, count)
+	for len(payload) > 0 {
+		size, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < size {
+			return nil, false
+		}
+		fields = append(fields, string(payload[n:n+int(size)]))
+		payload = payload[n+int(size):]
+	}
+	if len(fields) != count {
+		return nil, false
+	}
+
+	expire, _ := strconv.ParseInt(fields[2], 10, 64)
+	claims := &callbackClaims{
+		KeyID:    fields[0],
+		Nonce:    hex.EncodeToString([]byte(fields[1])),
+		Expire:   expire,
+		Ack:      fields[3],
+		Verifier: fields[4],
+		Sign:     hex.EncodeToString(sign),
+	}
+	if withAsyncID {
+		claims.AsyncID = fields[5]
+	}
+	return claims, true
+}
+
+// CallbackPattern 回调地址的路径，路径模式时保留占位符，可直接注册到http.ServeMux：
+//
+//	mux.Handle("POST "+client.CallbackPattern(), client.HTTPHandler())
+func (c *Client) CallbackPattern() string {
+	if c.pathTmpl != nil {
+		return c.pathTmpl.pattern()
+	}
+	u, err := url.Parse(c.callbackURL)
+	if err != nil {
+		return "/"
+	}
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
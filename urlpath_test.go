@@ -0,0 +1,132 @@
+package tosync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	cases := []struct {
+		url     string
+		ok      bool
+		isPath  bool
+		pattern string
+	}{
+		{"https://host/callback?from=test", true, false, ""},
+		{"https://host/cb/{async_id}/{sig}", true, true, "/cb/{async_id}/{sig}"},
+		{"https://host/cb/{sig}/notify", true, true, "/cb/{sig}/notify"},
+		{"https://host/cb/{async_id}", false, false, ""},                // 缺少{sig}
+		{"https://host/cb/{sig}/{sig}", false, false, ""},               // 重复
+		{"https://host/cb/{id}/{sig}", false, false, ""},                // 不支持的占位符
+		{"https://host/cb/x{async_id}/{sig}", false, false, ""},         // 不是完整的段
+		{"https://host/cb/{sig}?async_id={async_id}", false, false, ""}, // 占位符只能在路径中
+	}
+	for _, c := range cases {
+		tmpl, err := parsePathTemplate(c.url)
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: want ok %v, get %v", c.url, c.ok, err)
+		}
+		if (tmpl != nil) != c.isPath {
+			t.Fatalf("%s: want path mode %v", c.url, c.isPath)
+		}
+		if tmpl != nil && tmpl.pattern() != c.pattern {
+			t.Fatalf("%s: want pattern %s, get %s", c.url, c.pattern, tmpl.pattern())
+		}
+	}
+}
+
+func TestPathClaims(t *testing.T) {
+	for _, callbackURL := range []string{
+		"http://localhost/cb/{async_id}/{sig}?from=test",
+		"http://localhost/cb/{sig}?from=test",
+	} {
+		client := newSignTestClient(t)
+		client.callbackURL = callbackURL
+		tmpl, err := parsePathTemplate(callbackURL)
+		if err != nil {
+			t.Fatalf("parse template failed: %v", err)
+		}
+		client.pathTmpl = tmpl
+
+		signedURL, err := client.signedURL("async_id", new(Option).SetAck("vendor"))
+		if err != nil {
+			t.Fatalf("sign url failed: %v", err)
+		}
+		u, err := url.Parse(signedURL)
+		if err != nil {
+			t.Fatalf("parse signed url failed: %v", err)
+		}
+		if strings.ContainsAny(signedURL, "{}") || u.Query().Get("sign") != "" {
+			t.Fatalf("signed url not in path mode: %s", signedURL)
+		}
+		if u.Query().Get("from") != "test" {
+			t.Fatalf("query of template lost: %s", signedURL)
+		}
+
+		claims, err := client.verifyClaims(httptest.NewRequest(http.MethodPost, signedURL, nil))
+		if err != nil {
+			t.Fatalf("%s: verify failed: %v", signedURL, err)
+		}
+		if claims.AsyncID != "async_id" || claims.Ack != "vendor" {
+			t.Fatalf("claims not match: %+v", claims)
+		}
+
+		// 篡改签名中的任意字符
+		segments := strings.Split(u.Path, "/")
+		token := segments[len(segments)-1]
+		for _, i := range []int{0, len(token) / 2, len(token) - 1} {
+			forged := []byte(token)
+			if forged[i] == 'A' {
+				forged[i] = 'B'
+			} else {
+				forged[i] = 'A'
+			}
+			segments[len(segments)-1] = string(forged)
+			req := httptest.NewRequest(http.MethodPost, signedURL, nil)
+			req.URL.Path = strings.Join(segments, "/")
+			_, err = client.verifyClaims(req)
+			if !errors.Is(err, ErrInvalidSign) {
+				t.Fatalf("%s: want %v, get %v", req.URL.Path, ErrInvalidSign, err)
+			}
+		}
+
+		// 路径与模板不匹配
+		req := httptest.NewRequest(http.MethodPost, signedURL, nil)
+		req.URL.Path = "/other" + u.Path
+		_, err = client.verifyClaims(req)
+		if !errors.Is(err, ErrInvalidSign) {
+			t.Fatalf("want %v, get %v", ErrInvalidSign, err)
+		}
+	}
+
+	// 篡改路径中的async_id
+	client := newSignTestClient(t)
+	client.callbackURL = "http://localhost/cb/{async_id}/{sig}"
+	client.pathTmpl, _ = parsePathTemplate(client.callbackURL)
+	signedURL, err := client.signedURL("async_id", new(Option))
+	if err != nil {
+		t.Fatalf("sign url failed: %v", err)
+	}
+	forged := strings.Replace(signedURL, "/async_id/", "/other/", 1)
+	_, err = client.verifyClaims(httptest.NewRequest(http.MethodPost, forged, nil))
+	if !errors.Is(err, ErrInvalidSign) {
+		t.Fatalf("want %v, get %v", ErrInvalidSign, err)
+	}
+}
+
+func TestCallbackPattern(t *testing.T) {
+	client := newSignTestClient(t)
+	if get := client.CallbackPattern(); get != "/callback" {
+		t.Fatalf("want /callback, get %s", get)
+	}
+	client.callbackURL = "http://localhost/cb/{async_id}/{sig}"
+	client.pathTmpl, _ = parsePathTemplate(client.callbackURL)
+	if get := client.CallbackPattern(); get != "/cb/{async_id}/{sig}" {
+		t.Fatalf("want /cb/{async_id}/{sig}, get %s", get)
+	}
+}
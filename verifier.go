@@ -0,0 +1,138 @@
+package tosync
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidVendorSign = errors.New("invalid vendor sign")
+
+// CallbackVerifier 校验下游自己的签名（如支付网关对body的签名），在回调发布前执行，
+// 返回错误时回调被拒绝
+type CallbackVerifier interface {
+	Verify(r *http.Request, body []byte) error
+}
+
+type CallbackVerifierFunc func(r *http.Request, body []byte) error
+
+func (f CallbackVerifierFunc) Verify(r *http.Request, body []byte) error {
+	return f(r, body)
+}
+
+// HMACVerifier 校验header中对body的HMAC签名
+type HMACVerifier struct {
+	Header string                       // 签名所在的header
+	Secret []byte                       // 与下游约定的密钥
+	Hash   func() hash.Hash             // 默认sha256
+	Prefix string                       // 签名值的前缀，如"sha256="
+	Decode func(string) ([]byte, error) // 签名值的编码，默认hex
+}
+
+func NewHMACVerifier(header string, secret []byte) *HMACVerifier {
+	return &HMACVerifier{
+		Header: header,
+		Secret: secret,
+	}
+}
+
+func (v *HMACVerifier) Verify(r *http.Request, body []byte) error {
+	value := r.Header.Get(v.Header)
+	if value == "" {
+		return errors.Errorf("header %s is empty", v.Header)
+	}
+	if !strings.HasPrefix(value, v.Prefix) {
+		return errors.Errorf("header %s without prefix %s", v.Header, v.Prefix)
+	}
+	decode := v.Decode
+	if decode == nil {
+		decode = hex.DecodeString
+	}
+	got, err := decode(strings.TrimPrefix(value, v.Prefix))
+	if err != nil {
+		return errors.Wrapf(err, "decode header %s", v.Header)
+	}
+	newHash := v.Hash
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	mac := hmac.New(newHash, v.Secret)
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("hmac mismatch")
+	}
+	return nil
+}
+
+// PublicKeyVerifier 用下游的RSA（PKCS#1 v1.5）或ECDSA（ASN.1）公钥校验对body的签名
+type PublicKeyVerifier struct {
+	Header    string           // 签名所在的header，值为base64编码
+	PublicKey crypto.PublicKey // *rsa.PublicKey或*ecdsa.PublicKey
+	Hash      crypto.Hash      // 默认SHA256
+	// Signature 自定义签名的提取方式（如签名在body字段中），设置后忽略Header
+	Signature func(r *http.Request, body []byte) ([]byte, error)
+}
+
+func NewPublicKeyVerifier(header string, publicKey crypto.PublicKey) *PublicKeyVerifier {
+	return &PublicKeyVerifier{
+		Header:    header,
+		PublicKey: publicKey,
+	}
+}
+
+func (v *PublicKeyVerifier) Verify(r *http.Request, body []byte) error {
+	var sig []byte
+	var err error
+	if v.Signature != nil {
+		sig, err = v.Signature(r, body)
+	} else {
+		value := r.Header.Get(v.Header)
+		if value == "" {
+			return errors.Errorf("header %s is empty", v.Header)
+		}
+		sig, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil {
+		return errors.Wrap(err, "get signature")
+	}
+
+	hashType := v.Hash
+	if hashType == 0 {
+		hashType = crypto.SHA256
+	}
+	if !hashType.Available() {
+		return errors.Errorf("hash %v not available", hashType)
+	}
+	h := hashType.New()
+	h.Write(body)
+	digest := h.Sum(nil)
+
+	switch key := v.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, hashType, digest, sig)
+		if err != nil {
+			return errors.Wrap(err, "rsa verify")
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, sig) {
+			return errors.New("ecdsa verify failed")
+		}
+	default:
+		return errors.Errorf("public key %T not support", v.PublicKey)
+	}
+	return nil
+}
+
+// 按名字选择CallbackVerifier，名字为空时用默认的，没有时返回nil
+func (c *Client) callbackVerifier(name string) CallbackVerifier {
+	return c.verifiers[name]
+}
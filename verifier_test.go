@@ -0,0 +1,172 @@
+package tosync
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func hmacHex(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHMACVerifier(t *testing.T) {
+	body := `{"order":"1"}`
+	verifier := NewHMACVerifier("X-Signature", []byte("vendor_secret"))
+	verifier.Prefix = "sha256="
+
+	cases := []struct {
+		header string
+		ok     bool
+	}{
+		{"sha256=" + hmacHex("vendor_secret", body), true},
+		{hmacHex("vendor_secret", body), false},             // 缺少前缀
+		{"sha256=" + hmacHex("other_secret", body), false},  // 密钥不对
+		{"sha256=" + hmacHex("vendor_secret", "{}"), false}, // body被篡改
+		{"sha256=not_hex", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/callback", strings.NewReader(body))
+		if c.header != "" {
+			r.Header.Set("X-Signature", c.header)
+		}
+		err := verifier.Verify(r, []byte(body))
+		if (err == nil) != c.ok {
+			t.Fatalf("header %q: want ok %v, get %v", c.header, c.ok, err)
+		}
+	}
+}
+
+func TestPublicKeyVerifier(t *testing.T) {
+	body := []byte(`{"order":"1"}`)
+	digest := sha256.Sum256(body)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate rsa key failed: %v", err)
+	}
+	rsaSign, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("rsa sign failed: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ecdsa key failed: %v", err)
+	}
+	ecSign, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatalf("ecdsa sign failed: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		key  crypto.PublicKey
+		sign []byte
+		body []byte
+		ok   bool
+	}{
+		{"rsa", &rsaKey.PublicKey, rsaSign, body, true},
+		{"rsa tampered", &rsaKey.PublicKey, rsaSign, []byte("{}"), false},
+		{"ecdsa", &ecKey.PublicKey, ecSign, body, true},
+		{"ecdsa tampered", &ecKey.PublicKey, ecSign, []byte("{}"), false},
+		{"key mismatch", &ecKey.PublicKey, rsaSign, body, false},
+		{"key not support", "key", rsaSign, body, false},
+	}
+	for _, c := range cases {
+		verifier := NewPublicKeyVerifier("X-Signature", c.key)
+		r := httptest.NewRequest(http.MethodPost, "/callback", nil)
+		r.Header.Set("X-Signature", base64.StdEncoding.EncodeToString(c.sign))
+		err := verifier.Verify(r, c.body)
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: want ok %v, get %v", c.name, c.ok, err)
+		}
+	}
+
+	// 签名在body字段中
+	verifier := NewPublicKeyVerifier("", &rsaKey.PublicKey)
+	verifier.Signature = func(r *http.Request, body []byte) ([]byte, error) {
+		return rsaSign, nil
+	}
+	err = verifier.Verify(httptest.NewRequest(http.MethodPost, "/callback", nil), body)
+	if err != nil {
+		t.Fatalf("verify with custom signature failed: %v", err)
+	}
+}
+
+func TestCallbackVerifier(t *testing.T) {
+	ctx := context.Background()
+	rejectAll := CallbackVerifierFunc(func(r *http.Request, body []byte) error {
+		return errors.New("reject")
+	})
+	client, err := NewClient(nil, &Config{
+		CallbackURL:      "http://localhost/callback",
+		MaxCallbackBytes: 1024,
+		Stream:           "to_sync_test",
+		TimeoutSeconds:   10,
+		SignKeys:         testSignKeys,
+	}, new(ClientOption).
+		SetMessager(NewMemoryMessager(nil)).
+		SetVerifier("", rejectAll).
+		SetVerifier("vendor", NewHMACVerifier("X-Signature", []byte("vendor_secret"))))
+	if err != nil {
+		t.Fatalf("new client failed: %v", err)
+	}
+	defer client.Close(ctx)
+
+	// 默认的校验对所有回调生效
+	target, err := client.signedURL("async_id", new(Option))
+	if err != nil {
+		t.Fatalf("sign url failed: %v", err)
+	}
+	err = client.CallbackHandler(ctx, httptest.NewRequest(http.MethodPost, target, strings.NewReader("{}")))
+	if !errors.Is(err, ErrInvalidVendorSign) {
+		t.Fatalf("want ErrInvalidVendorSign, get %v", err)
+	}
+
+	// 按注册选择的校验方式替代默认的
+	target, err = client.signedURL("async_id", new(Option).SetVerifier("vendor"))
+	if err != nil {
+		t.Fatalf("sign url failed: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader("{}"))
+	r.Header.Set("X-Signature", hmacHex("other_secret", "{}"))
+	err = client.CallbackHandler(ctx, r)
+	if !errors.Is(err, ErrInvalidVendorSign) {
+		t.Fatalf("want ErrInvalidVendorSign, get %v", err)
+	}
+	r = httptest.NewRequest(http.MethodPost, target, strings.NewReader("{}"))
+	r.Header.Set("X-Signature", hmacHex("vendor_secret", "{}"))
+	err = client.CallbackHandler(ctx, r)
+	if err != nil {
+		t.Fatalf("callback failed: %v", err)
+	}
+
+	// 校验方式受签名保护，不能在地址中替换
+	forged := strings.Replace(target, "vfy=vendor", "vfy=other", 1)
+	err = client.CallbackHandler(ctx, httptest.NewRequest(http.MethodPost, forged, strings.NewReader("{}")))
+	if !errors.Is(err, ErrInvalidSign) {
+		t.Fatalf("want ErrInvalidSign, get %v", err)
+	}
+
+	// 未注册的校验方式
+	_, err = client.Regist(&TestReq{}, new(Option).SetVerifier("unknown"))
+	if err == nil {
+		t.Fatal("want error for unknown verifier")
+	}
+}